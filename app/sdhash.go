@@ -6,10 +6,12 @@ import (
 	"flag"
 	"fmt"
 	"github.com/eciavatta/sdhash"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 )
 
@@ -28,20 +30,47 @@ var genCompare = flag.Bool("g", false, "compare all pairs in source data")
 var threshold = flag.Int("t", 16, "only show results >=threshold")
 var blockSize = flag.Int("b", -1, "hashes input files in nKB blocks (a value <= 0 means stream mode)")
 var sampleSize = flag.Int("s", 0, "sample N filters for comparisons")
+var seed = flag.Int64("seed", sdhash.DefaultSeed, "seed used to sample filters for comparisons")
 var segmentSize = flag.Int("z", 128, "set file segment size, in MB")
+var parallelism = flag.Int("p", 0, "hash N files in parallel (a value <= 0 means one for each CPU)")
+var memoryLimit = flag.Int("memory", 1024, "limit the memory used to hash files in parallel, in MB (<= 0 means no limit)")
 var output = flag.String("o", "", "send output to files")
 var outputDir = flag.String("output-dir", "", "send output to files")
 var separator = flag.String("separator", "|", "for comparison results")
 var fast = flag.Bool("fast", false, "shrink sdbf filters for speedup")
+var explain = flag.Bool("explain", false, "list the matching regions of the compared files")
+var containment = flag.Bool("containment", false, "also show the scores of A contained in B and B in A")
 var validate = flag.Bool("validate", false, "parse SDBF file to check if it is valid")
 var index = flag.Bool("index", false, "generate indexes while hashing")
 var indexSearch = flag.String("index-search", "", "search directory of reference indexes")
 var verbose = flag.Bool("verbose", false, "warnings, debug and progress output")
 var version = flag.Bool("version", false, "produce help message")
 
+// commands are the subcommands of the tool, selected with the first argument. Their names are reserved, so a file
+// with the same name must be hashed with a path like ./db or after the -- argument.
+var commands = map[string]func(args []string){
+	"query": runQuery,
+	"db":    runDB,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if _, err := os.Stat(os.Args[1]); err == nil {
+				logWarning("running the %s subcommand: use ./%s or -- %s to hash the file with the same name",
+					os.Args[1], os.Args[1], os.Args[1])
+			}
+			command(os.Args[2:])
+			return
+		}
+	}
+
 	flag.Usage = func() {
-		_, _ = fmt.Fprintf(os.Stderr, "sdhash is a tool to calculate similarity digests.\n\n")
+		_, _ = fmt.Fprintf(os.Stderr, "sdhash is a tool to calculate similarity digests.\n\n"+
+			"usage: sdhash [options] files...\n       sdhash query [options] sample corpus.sdbf\n"+
+			"       sdhash db add|rm|query|compact [options] db-dir ...\n\n"+
+			"The first argument selects a subcommand if it is query or db: to hash a file with one of these names,\n"+
+			"use a path like ./db or put -- before the files.\n\n")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
@@ -54,8 +83,11 @@ func validateArgs() {
 		*segmentSize = 128
 	}
 	*segmentSize *= mb
-	if *fast {
-		logFatal("not implemented")
+	if *fast && !*compare && !*genCompare {
+		logWarning("fast mode is used only in comparisons")
+	}
+	if (*explain || *containment) && !*compare && !*genCompare {
+		logWarning("explain and containment modes are used only in comparisons")
 	}
 	if *index && *output != "" && *outputDir != "" {
 		logFatal("indexing require -o or -output-dir flag")
@@ -71,13 +103,6 @@ func validateArgs() {
 		*threshold = 0
 	}
 	if *indexSearch != "" {
-		if *blockSize == 0 {
-			logFatal("index searching only supported in block mode")
-		} else if *blockSize < 0 {
-			*blockSize = 16
-			logVerbose("setting block size to 16KB for index search")
-		}
-
 		if stat, err := os.Stat(*indexSearch); err != nil {
 			logFatal("failed to open index search directory: %s", err)
 		} else if !stat.IsDir() {
@@ -96,17 +121,21 @@ func run(inputList []string) {
 	validateArgs()
 
 	var searchIndexesNames []string
-	var searchIndexes []sdhash.BloomFilter
+	var searchIndexes sdhash.MultiIndex
 	if *indexSearch != "" {
-		var sdbfSearchSet map[string]*sdbfSet
-		if sdbfSearchSet, err = loadIndexSearchFiles(); err != nil {
+		var indexFiles []indexSearchFile
+		if indexFiles, err = loadIndexSearchFiles(); err != nil {
 			logFatal("failed to load index search files: %s", err)
 		}
-		searchIndexesNames = make([]string, 0, len(sdbfSearchSet))
-		searchIndexes = make([]sdhash.BloomFilter, 0, len(sdbfSearchSet))
-		for filePath, set := range sdbfSearchSet {
-			searchIndexesNames = append(searchIndexesNames, filePath)
-			searchIndexes = append(searchIndexes, set.index)
+		searchIndexesNames = make([]string, 0, len(indexFiles))
+		indexes := make([]sdhash.BloomFilter, 0, len(indexFiles))
+		for _, indexFile := range indexFiles {
+			searchIndexesNames = append(searchIndexesNames, indexFile.path)
+			indexes = append(indexes, indexFile.set.Index())
+		}
+		// the features are searched in all the indexes at once
+		if searchIndexes, err = sdhash.NewMultiIndex(indexes); err != nil {
+			logFatal("failed to combine index search files: %s", err)
 		}
 	}
 
@@ -123,30 +152,28 @@ func run(inputList []string) {
 				logWarning("%s is not readable or not found", file)
 				continue
 			}
-			if set1, err := NewSdbfSetFromFileName(file); err != nil {
+			if set1, err := loadSet(file); err != nil {
 				logWarning("failed to parse file %s: %s", file, err)
 			} else {
-				fmt.Printf("file %s is a valid sdbf and contains %d hashes", file, set1.Size())
+				fmt.Printf("file %s is a valid sdbf and contains %d hashes", file, set1.Len())
 			}
 		}
 		return
 	}
 
-	var set1 *sdbfSet
+	var set1 sdhash.Set
 	var tmpFile *os.File
-	var filesToHash map[string]os.FileInfo
+	var filesToHash []fileToHash
 	if len(inputList) == 1 && inputList[0] == "-" && !*targetList {
-		buff, err := ioutil.ReadAll(os.Stdin)
-		if err != nil {
-			logFatal("failed to read from stdin: %s", err)
-		}
 		if tmpFile, err = ioutil.TempFile("", "sdhash"); err != nil {
 			logFatal("failed to create temp file: %s", err)
 		}
-		filesToHash = make(map[string]os.FileInfo, 1)
-		filesToHash[tmpFile.Name()], _ = tmpFile.Stat()
-		_, _ = tmpFile.Write(buff)
+		if _, err = io.Copy(tmpFile, os.Stdin); err != nil {
+			logFatal("failed to read from stdin: %s", err)
+		}
 		_ = tmpFile.Close()
+		info, _ := os.Stat(tmpFile.Name())
+		filesToHash = []fileToHash{{path: tmpFile.Name(), info: info}}
 	} else if len(inputList) > 0 {
 		if filesToHash, err = listFilesToHash(inputList); err != nil {
 			logFatal("failed to find files to hash: %s", err)
@@ -165,86 +192,128 @@ func run(inputList []string) {
 		}
 	}
 	if *genCompare {
-		set1.SetSeparator((*separator)[0])
-		results := set1.CompareAll(*threshold, *fast)
-		writeCompareResults(results)
+		// in fast mode the digests are folded here, after they have been written to the output
+		if *fast {
+			set1 = foldSet(set1)
+		}
+		if err := writeCompareResults(func(w io.Writer) error {
+			return set1.CompareAll(*threshold, writeResults(w))
+		}); err != nil {
+			logFatal("failed to compare sdbf: %s", err)
+		}
 	} else if *indexSearch != "" {
-		var sb strings.Builder
 		sep := (*separator)[0]
-		for _, sdbf := range set1.items {
-			for pos, matches := range sdbf.GetSearchIndexesResults() {
-				for i, match := range matches {
-					if match >= uint32(*threshold) && searchIndexesNames != nil {
-						sb.WriteString(fmt.Sprintf("%s [%d] %c %s %c %d\n", sdbf.Name(), pos, sep,
-							searchIndexesNames[i], sep, match))
+		if err := writeCompareResults(func(w io.Writer) error {
+			for _, sdbf := range set1.Items() {
+				for pos, matches := range sdbf.GetSearchIndexesResults() {
+					for i, match := range matches {
+						if match >= uint32(*threshold) && searchIndexesNames != nil {
+							if _, err := fmt.Fprintf(w, "%s [%d] %c %s %c %d\n", sdbf.Name(), pos, sep,
+								searchIndexesNames[i], sep, match); err != nil {
+								return err
+							}
+						}
 					}
 				}
 			}
+			return nil
+		}); err != nil {
+			logFatal("failed to write index search results: %s", err)
 		}
-		writeCompareResults(sb.String())
 	}
 }
 
-func loadIndexSearchFiles() (map[string]*sdbfSet, error) {
-	sdbfFiles := make(map[string]*sdbfSet)
-	if infos, err := ioutil.ReadDir(*indexSearch); err == nil {
-		for _, info := range infos {
-			if !info.Mode().IsRegular() {
-				continue
-			} else if path.Ext(info.Name()) == ".sdbf" {
-				filePath := path.Join(*indexSearch, info.Name())
-				if sdbfFiles[filePath], err = NewSdbfSetFromFileName(filePath); err != nil {
-					return nil, err
-				}
-			} else if path.Ext(info.Name()) == ".idx" {
-				if bf, err := sdhash.NewBloomFilterFromIndexFile(info.Name()); err == nil {
-					sdbfName := strings.TrimSuffix(info.Name(), filepath.Ext(info.Name()))
-					if sdbfFile, ok := sdbfFiles[sdbfName]; !ok {
-						logVerbose("skipping %s, no valid sdbf file found", sdbfName)
-					} else {
-						sdbfFile.index = bf
-						logVerbose("loading index file %s", info.Name())
-					}
-				} else {
-					logWarning("skipping %s, which is not a valid index file", info.Name())
-				}
+// indexSearchFile is a reference sdbf file, with the index used to search its digests.
+type indexSearchFile struct {
+	path string
+	set  sdhash.Set
+}
+
+// loadIndexSearchFiles loads the reference sdbf files which have an index in the index search directory,
+// sorted by path.
+func loadIndexSearchFiles() ([]indexSearchFile, error) {
+	infos, err := ioutil.ReadDir(*indexSearch)
+	if err != nil {
+		return nil, err
+	}
+
+	sdbfFiles := make(map[string]sdhash.Set)
+	for _, info := range infos {
+		if info.Mode().IsRegular() && path.Ext(info.Name()) == ".sdbf" {
+			filePath := path.Join(*indexSearch, info.Name())
+			if sdbfFiles[filePath], err = loadSet(filePath); err != nil {
+				return nil, err
 			}
 		}
-	} else {
-		return nil, err
 	}
 
-	return sdbfFiles, nil
+	indexFiles := make([]indexSearchFile, 0, len(sdbfFiles))
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || path.Ext(info.Name()) != ".idx" {
+			continue
+		}
+		indexPath := path.Join(*indexSearch, info.Name())
+		if bf, err := sdhash.NewBloomFilterFromIndexFile(indexPath); err == nil {
+			sdbfPath := strings.TrimSuffix(indexPath, filepath.Ext(indexPath))
+			if set, ok := sdbfFiles[sdbfPath]; !ok {
+				logVerbose("skipping %s, no valid sdbf file found", sdbfPath)
+			} else {
+				set.SetIndex(bf)
+				indexFiles = append(indexFiles, indexSearchFile{path: sdbfPath, set: set})
+				logVerbose("loading index file %s", indexPath)
+			}
+		} else {
+			logWarning("skipping %s, which is not a valid index file", indexPath)
+		}
+	}
+	sort.Slice(indexFiles, func(i, j int) bool {
+		return indexFiles[i].path < indexFiles[j].path
+	})
+
+	return indexFiles, nil
 }
 
 func compareSdbf(inputList []string) error {
 	if len(inputList) <= 2 {
-		var set1, set2 *sdbfSet
-		var err error
-		if set1, err = NewSdbfSetFromFileName(inputList[0]); err != nil {
+		set1, err := loadSet(inputList[0])
+		if err != nil {
 			return err
 		}
-		set1.SetSeparator((*separator)[0])
 
-		var results string
 		if len(inputList) == 2 {
-			if set2, err = NewSdbfSetFromFileName(inputList[1]); err != nil {
+			set2, err := loadSet(inputList[1])
+			if err != nil {
 				return err
 			}
-			set2.SetSeparator((*separator)[0])
-			results = set1.CompareTo(set2, *threshold, uint32(*sampleSize), *fast)
-		} else {
-			results = set1.CompareAll(*threshold, *fast)
+			if *fast {
+				set2 = foldSet(set2)
+				set1 = foldSet(set1)
+			}
+			return writeCompareResults(func(w io.Writer) error {
+				if *sampleSize > 0 {
+					// the seed is recorded to make the sampled comparisons reproducible
+					if _, err := fmt.Fprintf(w, "# sample-size=%d seed=%d\n", *sampleSize, *seed); err != nil {
+						return err
+					}
+				}
+				return set1.CompareTo(set2, *threshold, uint32(*sampleSize), *seed, writeResults(w))
+			})
 		}
 
-		writeCompareResults(results)
-		return nil
+		if *fast {
+			set1 = foldSet(set1)
+		}
+		return writeCompareResults(func(w io.Writer) error {
+			return set1.CompareAll(*threshold, writeResults(w))
+		})
 	}
 	return errors.New("comparison requires 1 or 2 arguments")
 }
 
-func listFilesToHash(inputList []string) (map[string]os.FileInfo, error) {
-	filesToHash := make(map[string]os.FileInfo)
+// listFilesToHash returns the files to hash, sorted by path and without duplicates.
+func listFilesToHash(inputList []string) ([]fileToHash, error) {
+	filesToHash := make([]fileToHash, 0)
+	seen := make(map[string]bool)
 	logVerbose("building list of files to be hashed")
 
 	addFile := func(path string, info os.FileInfo, err error) error {
@@ -255,8 +324,12 @@ func listFilesToHash(inputList []string) (map[string]os.FileInfo, error) {
 		} else if info.Mode().IsRegular() && info.Size() < sdhash.MinFileSize {
 			logWarning("skipping %s because is too small", path)
 		} else if info.Mode().IsRegular() {
+			if seen[path] {
+				return nil
+			}
+			seen[path] = true
 			logVerbose("adding %s to files to hash", path)
-			filesToHash[path] = info
+			filesToHash = append(filesToHash, fileToHash{path: path, info: info})
 			if info.Size() > int64(*segmentSize) {
 				logWarning("file %s will be segmented in %d mb chunks prior to hashing", path, *segmentSize/mb)
 			}
@@ -291,17 +364,38 @@ func listFilesToHash(inputList []string) (map[string]os.FileInfo, error) {
 		}
 	}
 
+	sort.Slice(filesToHash, func(i, j int) bool {
+		return filesToHash[i].path < filesToHash[j].path
+	})
+
 	return filesToHash, nil
 }
 
-func writeCompareResults(results string) {
+// writeCompareResults calls produce with a writer to the compare results output, which is a file with the .compare
+// extension if an output name is specified, or the standard output otherwise.
+func writeCompareResults(produce func(w io.Writer) error) error {
+	var out io.Writer = os.Stdout
+	var file *os.File
 	if *output != "" {
-		if err := ioutil.WriteFile(*output+".compare", []byte(results), 0644); err != nil {
-			logFatal("failed to write compare results: %s", err)
+		var err error
+		if file, err = os.Create(*output + ".compare"); err != nil {
+			return err
 		}
-	} else {
-		fmt.Print(results)
+		out = file
+	}
+
+	w := bufio.NewWriter(out)
+	err := produce(w)
+	if err == nil {
+		err = w.Flush()
 	}
+	if file != nil {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
 }
 
 func logFatal(message string, args ...interface{}) {
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/eciavatta/sdhash/db"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dbCommands are the subcommands of the db command, which manage a persistent similarity database.
+var dbCommands = map[string]func(args []string){
+	"add":     runDBAdd,
+	"rm":      runDBRemove,
+	"query":   runDBQuery,
+	"compact": runDBCompact,
+}
+
+// metadataFlag collects the key=value pairs of a repeated flag.
+type metadataFlag map[string]string
+
+func (m metadataFlag) String() string {
+	pairs := make([]string, 0, len(m))
+	for key, value := range m {
+		pairs = append(pairs, key+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m metadataFlag) Set(value string) error {
+	pair := strings.SplitN(value, "=", 2)
+	if len(pair) != 2 || pair[0] == "" {
+		return fmt.Errorf("%s is not a key=value pair", value)
+	}
+	m[pair[0]] = pair[1]
+	return nil
+}
+
+// runDB runs a subcommand of the db command.
+func runDB(args []string) {
+	if len(args) > 0 {
+		if command, ok := dbCommands[args[0]]; ok {
+			command(args[1:])
+			return
+		}
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "usage: sdhash db add [options] db-dir files...\n"+
+		"       sdhash db rm db-dir names...\n"+
+		"       sdhash db query [options] db-dir sample\n"+
+		"       sdhash db compact db-dir\n")
+	os.Exit(2)
+}
+
+// runDBAdd adds the digests of files or sdbf files to a database, as a single batch.
+func runDBAdd(args []string) {
+	flags := flag.NewFlagSet("db add", flag.ExitOnError)
+	metadata := make(metadataFlag)
+	flags.Var(metadata, "m", "add a key=value metadata to the digests (can be repeated)")
+	flags.IntVar(blockSize, "b", -1, "hashes input files in nKB blocks (a value <= 0 means stream mode)")
+	flags.IntVar(segmentSize, "z", 128, "set file segment size, in MB")
+	flags.BoolVar(verbose, "verbose", false, "warnings, debug and progress output")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: sdhash db add [options] db-dir files...\n\n"+
+			"The files can be files to hash or sdbf files. The feature indexes of the hashed files are merged\n"+
+			"into the database index.\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	validateArgs()
+
+	var records []db.Record
+	for _, filePath := range flags.Args()[1:] {
+		sdbfs, err := loadQueries(filePath)
+		if err != nil {
+			logFatal("failed to load %s: %s", filePath, err)
+		}
+		absPath, err := filepath.Abs(filePath)
+		if err != nil {
+			logFatal("failed to load %s: %s", filePath, err)
+		}
+		for _, sdbf := range sdbfs {
+			recordMetadata := map[string]string{"path": absPath}
+			for key, value := range metadata {
+				recordMetadata[key] = value
+			}
+			records = append(records, db.Record{Sdbf: sdbf, Metadata: recordMetadata})
+		}
+	}
+
+	d := openDB(flags.Arg(0))
+	if err := d.Add(records...); err != nil {
+		logFatal("failed to add digests: %s", err)
+	}
+	closeDB(d)
+	logVerbose("added %d digests to %s", len(records), flags.Arg(0))
+}
+
+// runDBRemove removes the digests with the specified names from a database.
+func runDBRemove(args []string) {
+	flags := flag.NewFlagSet("db rm", flag.ExitOnError)
+	flags.BoolVar(verbose, "verbose", false, "warnings, debug and progress output")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: sdhash db rm [options] db-dir names...\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	d := openDB(flags.Arg(0))
+	for _, name := range flags.Args()[1:] {
+		removed, err := d.Remove(name)
+		if err != nil {
+			logFatal("failed to remove %s: %s", name, err)
+		} else if removed == 0 {
+			logWarning("%s not found", name)
+		}
+		logVerbose("removed %d digests named %s", removed, name)
+	}
+	closeDB(d)
+}
+
+// runDBQuery finds the digests of a database which are the most similar to the digests of a sample.
+func runDBQuery(args []string) {
+	flags := flag.NewFlagSet("db query", flag.ExitOnError)
+	k := flags.Int("k", 10, "show the best N matches for each digest of the sample")
+	flags.IntVar(threshold, "t", 1, "only show results >=threshold")
+	flags.IntVar(blockSize, "b", -1, "hashes the sample in nKB blocks (a value <= 0 means stream mode)")
+	flags.IntVar(segmentSize, "z", 128, "set sample segment size, in MB")
+	flags.StringVar(output, "o", "", "send output to files")
+	flags.StringVar(separator, "separator", "|", "for comparison results")
+	flags.BoolVar(verbose, "verbose", false, "warnings, debug and progress output")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: sdhash db query [options] db-dir sample\n\n"+
+			"The sample can be a file to hash or a sdbf file.\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	validateArgs()
+
+	queries, err := loadQueries(flags.Arg(1))
+	if err != nil {
+		logFatal("failed to load sample: %s", err)
+	}
+	d := openDB(flags.Arg(0))
+	if err := writeCompareResults(func(w io.Writer) error {
+		writeResult := writeResults(w)
+		for _, query := range queries {
+			results, err := d.Query(query, *k)
+			if err != nil {
+				return err
+			}
+			for _, result := range results {
+				if result.Score < *threshold {
+					break
+				}
+				if err := writeResult(result); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		logFatal("failed to query database: %s", err)
+	}
+	closeDB(d)
+}
+
+// runDBCompact removes the deleted digests from a database.
+func runDBCompact(args []string) {
+	flags := flag.NewFlagSet("db compact", flag.ExitOnError)
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: sdhash db compact db-dir\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	d := openDB(flags.Arg(0))
+	if err := d.Compact(); err != nil {
+		logFatal("failed to compact database: %s", err)
+	}
+	closeDB(d)
+}
+
+// openDB opens the database in dir, or exits if it can't be opened.
+func openDB(dir string) db.DB {
+	d, err := db.Open(dir)
+	if err != nil {
+		logFatal("failed to open database: %s", err)
+	}
+	return d
+}
+
+// closeDB closes a database, or exits if it can't be closed.
+func closeDB(d db.DB) {
+	if err := d.Close(); err != nil {
+		logFatal("failed to close database: %s", err)
+	}
+}
@@ -3,45 +3,124 @@ package main
 import (
 	"fmt"
 	"github.com/eciavatta/sdhash"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"runtime"
+	"strings"
+	"sync"
 )
 
-func hashFiles(files map[string]os.FileInfo, searchIndexes []sdhash.BloomFilter) (*sdbfSet, error) {
+// fileToHash is a file to be digested.
+type fileToHash struct {
+	path string
+	info os.FileInfo
+}
+
+// hashResult is the result of the digesting process of a file.
+type hashResult struct {
+	sdbfs []sdhash.Sdbf
+	index sdhash.BloomFilter
+	err   error
+}
+
+// hashJob is a file to be digested by a hashing worker.
+type hashJob struct {
+	filePath string
+	file     os.FileInfo
+	index    sdhash.BloomFilter
+	cost     int64
+	out      chan hashResult
+}
+
+// hashFiles digests the files using a pool of workers. Files are digested concurrently, but the digests are written
+// to the output in the order of files. The memory used by the files digested at the same time is limited by the memory
+// budget.
+func hashFiles(files []fileToHash, searchIndexes sdhash.MultiIndex) (sdhash.Set, error) {
 	var rollIndex sdhash.BloomFilter
 	if *index && *output != "" {
 		rollIndex = sdhash.NewBloomFilter()
 	}
 
-	set := NewSdbfSetFromIndex(rollIndex)
-	for filePath, file := range files {
-		// todo: dd mode chunks -- hint: io.ReadFull()
-		if factory, err := sdhash.CreateSdbfFromFilename(filePath); err == nil {
-			var ddBlockSize uint32
-			if (*blockSize < 0 && file.Size() < 16*mb) || *blockSize == 0 {
-				ddBlockSize = 0
-			} else {
-				ddBlockSize = uint32(*blockSize) * kb
-			}
-			logVerbose("digesting file %s using block-size %d", filePath, ddBlockSize)
-			sdbf := factory.WithBlockSize(ddBlockSize).WithInitialIndex(rollIndex).WithSearchIndexes(searchIndexes).Compute()
-			set.AddHash(sdbf)
-			if *outputDir != "" {
-				outputFilePath := path.Join(*outputDir, file.Name()) + ".sdbf"
-				if err := ioutil.WriteFile(outputFilePath, []byte(sdbf.String()), 0644); err != nil {
+	workers := *parallelism
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if rollIndex != nil && workers > 1 {
+		// the features already present in the index are skipped, so the digests depend on the order of the files
+		logVerbose("hashing files sequentially to generate a single index")
+		workers = 1
+	}
+	budget := newMemoryBudget(int64(*memoryLimit) * mb)
+
+	jobs := make(chan hashJob)
+	pending := make(chan hashJob, 2*workers)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for _, file := range files {
+			job := hashJob{
+				filePath: file.path,
+				file:     file.info,
+				index:    rollIndex,
+				out:      make(chan hashResult, 1),
+			}
+			if job.index == nil && *index && *outputDir != "" {
+				job.index = sdhash.NewBloomFilter()
+			}
+			job.cost = budget.cost(file.info.Size(), rollIndex != nil)
+			select {
+			case pending <- job:
+			case <-done:
+				return
+			}
+			budget.acquire(job.cost)
+			select {
+			case jobs <- job:
+			case <-done:
+				budget.release(job.cost)
+				return
+			}
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				sdbfs, err := hashFile(job.filePath, job.file, job.index, searchIndexes)
+				budget.release(job.cost)
+				job.out <- hashResult{sdbfs: sdbfs, index: job.index, err: err}
+			}
+		}()
+	}
+
+	set := sdhash.NewSet(rollIndex)
+	for job := range pending {
+		result := <-job.out
+		if result.err != nil {
+			return nil, result.err
+		}
+
+		var sb strings.Builder
+		for _, sdbf := range result.sdbfs {
+			set.Add(sdbf)
+			sb.WriteString(sdbf.String())
+		}
+		if *outputDir != "" {
+			outputFilePath := path.Join(*outputDir, job.file.Name()) + ".sdbf"
+			if err := ioutil.WriteFile(outputFilePath, []byte(sb.String()), 0644); err != nil {
+				return nil, err
+			}
+			if *index {
+				if err := result.index.WriteToFile(outputFilePath + ".idx"); err != nil {
 					return nil, err
 				}
-				if *index {
-					if err := sdbf.GetIndex().WriteToFile(outputFilePath + ".idx"); err != nil {
-						return nil, err
-					}
-				}
-			} else if *output == "" {
-				fmt.Print(sdbf.String())
 			}
-		} else {
-			return nil, err
+		} else if *output == "" {
+			fmt.Print(sb.String())
 		}
 	}
 
@@ -51,7 +130,7 @@ func hashFiles(files map[string]os.FileInfo, searchIndexes []sdhash.BloomFilter)
 			return nil, err
 		}
 		if *index {
-			if err := set.index.WriteToFile(outputFilePath + ".idx"); err != nil {
+			if err := set.Index().WriteToFile(outputFilePath + ".idx"); err != nil {
 				return nil, err
 			}
 		}
@@ -59,3 +138,218 @@ func hashFiles(files map[string]os.FileInfo, searchIndexes []sdhash.BloomFilter)
 
 	return set, nil
 }
+
+// fileBlockSize returns the block size used to digest a file, or 0 if the file must be digested in stream mode.
+// Without a block size specified by the user, files smaller than 16MB are digested in stream mode, and larger files
+// are digested in 16KB blocks.
+func fileBlockSize(size int64) uint32 {
+	if *blockSize == 0 || (*blockSize < 0 && size < 16*mb) {
+		return 0
+	} else if *blockSize < 0 {
+		return 16 * kb
+	}
+	return uint32(*blockSize) * kb
+}
+
+// segmentOffsets holds the offset in their file of the segments digested by hashFile, so that the matching regions
+// of a segment can be reported relative to its file. The segments loaded from sdbf files are not present, because
+// the segment size used to digest them is unknown.
+var segmentOffsets sync.Map
+
+// hashFile digests a file. Files larger than the segment size are split in consecutive segments, and each segment
+// is digested in its own sdhash.Sdbf, named after the file with the segment number as suffix. The block size of each
+// segment is chosen from the size of the segment.
+func hashFile(filePath string, file os.FileInfo, index sdhash.BloomFilter,
+	searchIndexes sdhash.MultiIndex) ([]sdhash.Sdbf, error) {
+	if file.Size() <= int64(*segmentSize) {
+		ddBlockSize := fileBlockSize(file.Size())
+		logVerbose("digesting file %s using block-size %d", filePath, ddBlockSize)
+		factory, err := sdhash.CreateSdbfFromFilename(filePath)
+		if err != nil {
+			return nil, err
+		}
+		sdbf, err := factory.WithBlockSize(ddBlockSize).WithInitialIndex(index).WithSearchMultiIndex(searchIndexes).Compute()
+		if err != nil {
+			return nil, err
+		}
+		return []sdhash.Sdbf{sdbf}, nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var sdbfs []sdhash.Sdbf
+	for i, offset := 0, int64(0); offset < file.Size(); i, offset = i+1, offset+int64(*segmentSize) {
+		segmentName := fmt.Sprintf("%s.%04d", file.Name(), i)
+		segmentLength := file.Size() - offset
+		if segmentLength > int64(*segmentSize) {
+			segmentLength = int64(*segmentSize)
+		}
+		factory, err := sdhash.CreateSdbfFromReader(io.NewSectionReader(f, offset, segmentLength))
+		if err != nil {
+			logWarning("skipping segment %s: %s", segmentName, err)
+			continue
+		}
+		ddBlockSize := fileBlockSize(segmentLength)
+		logVerbose("digesting segment %s of file %s using block-size %d", segmentName, filePath, ddBlockSize)
+		sdbf, err := factory.WithBlockSize(ddBlockSize).WithInitialIndex(index).WithSearchMultiIndex(searchIndexes).
+			WithName(segmentName).Compute()
+		if err != nil {
+			return nil, err
+		}
+		segmentOffsets.Store(sdbf, offset)
+		sdbfs = append(sdbfs, sdbf)
+	}
+
+	return sdbfs, nil
+}
+
+// loadSet loads all the sdhash.Sdbf contained in a file into a new set.
+func loadSet(filename string) (sdhash.Set, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	sdbfs, err := sdhash.NewReader(file).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	set := sdhash.NewSet(nil) // right now we cannot read-in an index, but we can set one later
+	set.Add(sdbfs...)
+
+	return set, nil
+}
+
+// foldSet returns a new set with the fast mode version of all the sdhash.Sdbf in a set.
+func foldSet(set sdhash.Set) sdhash.Set {
+	folded := sdhash.NewSet(set.Index())
+	set.Range(func(sdbf sdhash.Sdbf) bool {
+		foldedSdbf := sdbf.Folded()
+		if offset, ok := segmentOffsets.Load(sdbf); ok {
+			segmentOffsets.Store(foldedSdbf, offset)
+		}
+		folded.Add(foldedSdbf)
+		return true
+	})
+	return folded
+}
+
+// writeResults returns a sdhash.ResultFunc which writes each comparison result in a line, using the separator
+// specified by the user. In containment mode, the scores of the first digest contained in the second one and vice versa
+// are appended to the line. In explain mode, each result is followed by the matching regions of the two digests.
+func writeResults(w io.Writer) sdhash.ResultFunc {
+	sep := (*separator)[0]
+	return func(result sdhash.Result) error {
+		_, err := fmt.Fprintf(w, "%s%c%s%c%03d", result.Query.Name(), sep, result.Target.Name(), sep, result.Score)
+		if err == nil && *containment {
+			var queryInTarget, targetInQuery int
+			if queryInTarget, targetInQuery, err = result.Query.Containment(result.Target); err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "%c%03d%c%03d", sep, queryInTarget, sep, targetInQuery)
+		}
+		if err == nil {
+			_, err = fmt.Fprintln(w)
+		}
+		if err != nil || !*explain {
+			return err
+		}
+
+		_, regions, err := result.Query.CompareDetailed(result.Target)
+		if err != nil {
+			return err
+		}
+		for _, region := range regions {
+			_, err = fmt.Fprintf(w, "\t%s%c%s%c%03d\n",
+				formatRegion(result.Query, region.FilterA, region.OffsetA, region.LengthA), sep,
+				formatRegion(result.Target, region.FilterB, region.OffsetB, region.LengthB), sep, region.Score)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// formatRegion formats the byte range of a matching region of sdbf, or the filter index if the range is unknown.
+// The range of a segment is relative to the start of its file.
+func formatRegion(sdbf sdhash.Sdbf, filter uint32, offset int64, length int64) string {
+	if offset < 0 {
+		return fmt.Sprintf("filter %d", filter)
+	}
+	if segmentOffset, ok := segmentOffsets.Load(sdbf); ok {
+		offset += segmentOffset.(int64)
+	}
+	return fmt.Sprintf("%d-%d", offset, offset+length)
+}
+
+const (
+	hashWindowSize   = 32 * mb // size of the input kept in memory while digesting a file
+	hashWindowFactor = 5       // bytes used for each byte of the window: the input, its ranks and its scores
+	hashOverhead     = 1 * mb  // memory used by each digest, independently of the size of the file
+	hashIndexSize    = 64 * mb // size of the index created for each file, unless a single index is shared
+)
+
+// memoryBudget limits the memory used by the files which are digested at the same time.
+type memoryBudget struct {
+	limit     int64
+	available int64
+	cond      *sync.Cond
+}
+
+// newMemoryBudget creates a memoryBudget of limit bytes. A limit lower or equal than 0 means no limit.
+func newMemoryBudget(limit int64) *memoryBudget {
+	return &memoryBudget{
+		limit:     limit,
+		available: limit,
+		cond:      sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+// cost returns the part of the budget required to digest a file of the specified size. Each file is digested with
+// its own index, even if it is discarded, unless sharedIndex is true. The input is digested in windows, so the cost
+// grows with the size of the file only up to hashWindowSize. Files which require more than the budget can be
+// digested, but only one at a time.
+func (b *memoryBudget) cost(size int64, sharedIndex bool) int64 {
+	if b.limit <= 0 {
+		return 0
+	}
+	if size > hashWindowSize {
+		size = hashWindowSize
+	}
+	cost := size*hashWindowFactor + hashOverhead
+	if !sharedIndex {
+		cost += hashIndexSize
+	}
+	if cost > b.limit {
+		return b.limit
+	}
+	return cost
+}
+
+// acquire waits until n bytes of the budget are available and reserves them.
+func (b *memoryBudget) acquire(n int64) {
+	b.cond.L.Lock()
+	for b.available < n {
+		b.cond.Wait()
+	}
+	b.available -= n
+	b.cond.L.Unlock()
+}
+
+// release returns n bytes to the budget.
+func (b *memoryBudget) release(n int64) {
+	b.cond.L.Lock()
+	b.available += n
+	b.cond.L.Unlock()
+	b.cond.Broadcast()
+}
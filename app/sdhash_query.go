@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/eciavatta/sdhash"
+	"io"
+	"os"
+	"path"
+)
+
+// runQuery finds the digests of one or more corpus files which are the most similar to the digests of a sample.
+func runQuery(args []string) {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	k := flags.Int("k", 10, "show the best N matches for each digest of the sample")
+	lshBands := flags.Int("lsh-bands", 0, "compare only the LSH candidates, using N bands (0 compares all the corpus)")
+	lshRows := flags.Int("lsh-rows", sdhash.DefaultLSHParams().Rows, "use N MinHash values in each LSH band")
+	flags.IntVar(blockSize, "b", -1, "hashes the sample in nKB blocks (a value <= 0 means stream mode)")
+	flags.IntVar(segmentSize, "z", 128, "set sample segment size, in MB")
+	flags.StringVar(output, "o", "", "send output to files")
+	flags.StringVar(separator, "separator", "|", "for comparison results")
+	flags.BoolVar(explain, "explain", false, "list the matching regions of the compared files")
+	flags.BoolVar(containment, "containment", false, "also show the scores of A contained in B and B in A")
+	flags.BoolVar(verbose, "verbose", false, "warnings, debug and progress output")
+	flags.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "usage: sdhash query [options] sample corpus.sdbf [corpus.sdbf...]\n\n"+
+			"The sample can be a file to hash or a sdbf file.\n\n")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	validateArgs()
+
+	queries, err := loadQueries(flags.Arg(0))
+	if err != nil {
+		logFatal("failed to load sample: %s", err)
+	}
+	corpus := sdhash.NewSet(nil)
+	for _, corpusPath := range flags.Args()[1:] {
+		set, err := loadSet(corpusPath)
+		if err != nil {
+			logFatal("failed to load corpus: %s", err)
+		}
+		corpus.Add(set.Items()...)
+	}
+	query := corpus.Query
+	if *lshBands > 0 {
+		index, err := sdhash.NewLSHIndex(sdhash.LSHParams{Bands: *lshBands, Rows: *lshRows, Seed: sdhash.DefaultSeed})
+		if err != nil {
+			logFatal("failed to create LSH index: %s", err)
+		}
+		if err := index.Add(corpus.Items()...); err != nil {
+			logFatal("failed to index corpus: %s", err)
+		}
+		query = index.Query
+	}
+
+	if err := writeCompareResults(func(w io.Writer) error {
+		writeResult := writeResults(w)
+		for _, sample := range queries {
+			results, err := query(sample, *k)
+			if err != nil {
+				return err
+			}
+			for _, result := range results {
+				if err := writeResult(result); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		logFatal("failed to query corpus: %s", err)
+	}
+}
+
+// loadQueries loads the digests of a sdbf file, or digests a file if it is not a sdbf file.
+func loadQueries(filePath string) ([]sdhash.Sdbf, error) {
+	if path.Ext(filePath) == ".sdbf" {
+		set, err := loadSet(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return set.Items(), nil
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return hashFile(filePath, info, nil, nil)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"github.com/eciavatta/sdhash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const runMainEnv = "SDHASH_TEST_RUN_MAIN"
+
+// TestMain runs the command instead of the tests if the test binary is executed by runSdhash.
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runSdhash executes the command in dir with the specified arguments, and returns its standard output.
+func runSdhash(t *testing.T, dir string, args ...string) []byte {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	out, err := cmd.Output()
+	require.NoError(t, err, "sdhash %v", args)
+	return out
+}
+
+func TestDeterministicOutput(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sdhash-app-test")
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	r := rand.New(rand.NewSource(1))
+	buf := make([]uint8, 256*kb)
+	_, err = r.Read(buf)
+	require.NoError(t, err)
+	inputDir := filepath.Join(tmpDir, "input")
+	require.NoError(t, os.MkdirAll(filepath.Join(inputDir, "nested"), 0755))
+	for i, name := range []string{"e", "b", "nested/d", "a", "nested/c", "f", "h", "g"} {
+		// files share a part of the content, so that comparisons produce results
+		data := append(append([]uint8{}, buf[:64*kb]...), buf[64*kb+i*16*kb:64*kb+(i+1)*16*kb]...)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(inputDir, name), data, 0644))
+	}
+	refDir := filepath.Join(tmpDir, "ref")
+	require.NoError(t, os.Mkdir(refDir, 0755))
+	runSdhash(t, inputDir, "-b", "1", "-index", "-output-dir", refDir, "a", "b", "e", "f")
+
+	for _, args := range [][]string{
+		{"-r", "."},
+		{"-r", "-b", "1", "."},
+		{"-r", "-g", "."},
+		{"-r", "-b", "1", "-index-search", refDir, "."},
+		{"-r", "-index-search", refDir, "."},
+	} {
+		sequential := runSdhash(t, inputDir, append([]string{"-p", "1"}, args...)...)
+		assert.NotEmpty(t, sequential)
+		for i := 0; i < 2; i++ {
+			parallel := runSdhash(t, inputDir, append([]string{"-p", "4"}, args...)...)
+			assert.Equal(t, string(sequential), string(parallel), "sdhash %v", args)
+		}
+	}
+
+	runSdhash(t, inputDir, "-r", "-p", "4", "-o", filepath.Join(tmpDir, "all"), ".")
+	for _, args := range [][]string{
+		{"-c", "all.sdbf"},
+		{"-c", "all.sdbf", "all.sdbf"},
+		{"-s", "1", "-seed", "7", "-c", "all.sdbf", "all.sdbf"},
+		{"-s", "1", "-c", "all.sdbf", "all.sdbf"},
+	} {
+		first := runSdhash(t, tmpDir, args...)
+		assert.NotEmpty(t, first)
+		assert.Equal(t, string(first), string(runSdhash(t, tmpDir, args...)), "sdhash %v", args)
+	}
+
+	results := strings.Split(string(runSdhash(t, inputDir, "query", "-k", "3", "a", filepath.Join(tmpDir, "all.sdbf"))), "\n")
+	require.Len(t, results, 4)
+	assert.Equal(t, "a|a|100", results[0])
+	assert.Empty(t, results[3])
+
+	lshResults := strings.Split(string(runSdhash(t, inputDir, "query", "-k", "3", "-lsh-bands", "32", "a",
+		filepath.Join(tmpDir, "all.sdbf"))), "\n")
+	require.NotEmpty(t, lshResults)
+	assert.Equal(t, "a|a|100", lshResults[0])
+
+	assert.True(t, strings.HasPrefix(string(runSdhash(t, tmpDir, "-s", "1", "-seed", "7", "-c", "all.sdbf", "all.sdbf")),
+		"# sample-size=1 seed=7\n"))
+	assert.True(t, strings.HasPrefix(string(runSdhash(t, tmpDir, "-s", "1", "-c", "all.sdbf", "all.sdbf")),
+		"# sample-size=1 seed=0\n"))
+}
+
+func TestSegmentation(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sdhash-app-test")
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	// the last segment is shorter than sdhash.MinFileSize, so it is skipped
+	buf := make([]uint8, 2*mb+sdhash.MinFileSize-1)
+	_, err = rand.New(rand.NewSource(3)).Read(buf)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "large"), buf, 0644))
+
+	lines := strings.Split(strings.TrimSpace(string(runSdhash(t, tmpDir, "-z", "1", "large"))), "\n")
+	require.Len(t, lines, 2)
+	for i, name := range []string{"large.0000", "large.0001"} {
+		sd, err := sdhash.ParseSdbfFromString(lines[i])
+		require.NoError(t, err)
+		assert.Equal(t, name, sd.Name())
+		assert.Equal(t, uint64(mb), sd.InputSize())
+
+		factory, err := sdhash.CreateSdbfFromBytes(buf[i*mb : (i+1)*mb])
+		require.NoError(t, err)
+		expected, err := factory.WithName(name).Compute()
+		require.NoError(t, err)
+		assert.Equal(t, expected.String(), lines[i]+"\n")
+	}
+
+	// the matching regions of a segment are relative to the start of the file
+	part := buf[mb+64*kb : mb+320*kb]
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "part"), part, 0644))
+	var results []string
+	for _, line := range strings.Split(string(runSdhash(t, tmpDir, "-z", "1", "-b", "16", "-g", "-explain",
+		"large", "part")), "\n") {
+		if !strings.HasPrefix(line, "sdbf") {
+			results = append(results, line)
+		}
+	}
+	require.True(t, len(results) > 2)
+	assert.Equal(t, "large.0001|part|100", results[0])
+	assert.Equal(t, "\t1114112-1130496|0-16384|100", results[1])
+
+	// the block size is chosen from the size of each segment, instead of the size of the file
+	if testing.Short() {
+		return
+	}
+	buf = make([]uint8, 16*mb)
+	_, err = rand.New(rand.NewSource(5)).Read(buf)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, "huge"), buf, 0644))
+	lines = strings.Split(strings.TrimSpace(string(runSdhash(t, tmpDir, "-z", "8", "huge"))), "\n")
+	require.Len(t, lines, 2)
+	for _, line := range lines {
+		assert.True(t, strings.HasPrefix(line, "sdbf:"), "segment digested in block mode")
+	}
+}
+
+func TestReservedNames(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sdhash-app-test")
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	buf := make([]uint8, 64*kb)
+	_, err = rand.New(rand.NewSource(4)).Read(buf)
+	require.NoError(t, err)
+	for _, name := range []string{"db", "query"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, name), buf, 0644))
+		for _, args := range [][]string{{"--", name}, {"./" + name}} {
+			sd, err := sdhash.ParseSdbfFromString(string(runSdhash(t, tmpDir, args...)))
+			require.NoError(t, err, "sdhash %v", args)
+			assert.Equal(t, name, sd.Name())
+		}
+
+		// the subcommand is still selected, but not silently
+		cmd := exec.Command(os.Args[0], name)
+		cmd.Dir = tmpDir
+		cmd.Env = append(os.Environ(), runMainEnv+"=1")
+		out, _ := cmd.CombinedOutput()
+		assert.Contains(t, string(out), "warning: running the "+name+" subcommand")
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	budget := newMemoryBudget(512 * mb)
+	large := budget.cost(4*1024*mb, true)
+	assert.Equal(t, budget.cost(hashWindowSize, true), large)
+	assert.True(t, budget.cost(4*kb, true) > 4*kb)
+	assert.Equal(t, budget.cost(4*kb, true)+hashIndexSize, budget.cost(4*kb, false))
+	assert.Equal(t, int64(0), newMemoryBudget(0).cost(4*1024*mb, false))
+	assert.Equal(t, int64(64*mb), newMemoryBudget(64*mb).cost(4*kb, false))
+
+	// the cost of files larger than the hashing window is bounded, so several of them are digested concurrently
+	acquired := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			budget.acquire(large)
+		}
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("large files are not digested concurrently")
+	}
+
+	// a file which costs more than the budget takes all of it, so it is digested alone
+	small := newMemoryBudget(64 * mb)
+	whole := small.cost(4*1024*mb, false)
+	require.Equal(t, int64(64*mb), whole)
+	other := small.cost(4*kb, true)
+	small.acquire(other)
+	acquired = make(chan struct{})
+	go func() {
+		small.acquire(whole)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("a file larger than the budget is digested with other files")
+	case <-time.After(100 * time.Millisecond):
+	}
+	small.release(other)
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("a file larger than the budget is not digested")
+	}
+	acquired = make(chan struct{})
+	go func() {
+		small.acquire(other)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("other files are digested with a file larger than the budget")
+	case <-time.After(100 * time.Millisecond):
+	}
+	small.release(whole)
+	<-acquired
+}
+
+func TestDatabase(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sdhash-app-test")
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	buf := make([]uint8, 512*kb)
+	_, err = rand.New(rand.NewSource(2)).Read(buf)
+	require.NoError(t, err)
+	for i, name := range []string{"a", "b", "c"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(tmpDir, name), buf[i*128*kb:(i+2)*128*kb], 0644))
+	}
+
+	runSdhash(t, tmpDir, "db", "add", "-m", "case=1", "refs", "a", "b")
+	runSdhash(t, tmpDir, "db", "add", "refs", "c")
+	results := strings.Split(string(runSdhash(t, tmpDir, "db", "query", "-k", "2", "refs", "a")), "\n")
+	require.Len(t, results, 3)
+	assert.Equal(t, "a|a|100", results[0])
+	assert.True(t, strings.HasPrefix(results[1], "a|b|"), results[1])
+
+	runSdhash(t, tmpDir, "db", "rm", "refs", "a")
+	runSdhash(t, tmpDir, "db", "compact", "refs")
+	results = strings.Split(string(runSdhash(t, tmpDir, "db", "query", "refs", "a")), "\n")
+	require.Len(t, results, 2)
+	assert.True(t, strings.HasPrefix(results[0], "a|b|"), results[0])
+}
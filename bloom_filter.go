@@ -40,6 +40,11 @@ type BloomFilter interface {
 	// String returns the serialized representation of the BloomFilter.
 	String() string
 
+	// Merge adds all the elements of other to the BloomFilter. The two BloomFilter must have the same size and the same
+	// number of hash functions, otherwise ErrIncompatibleBloomFilter is returned. The elements count of the merged
+	// BloomFilter is the sum of the elements count of the two BloomFilter, so it is an upper bound.
+	Merge(other BloomFilter) error
+
 	insertSha1(sha1 []uint32) bool
 	querySha1(sha1 []uint32) bool
 }
@@ -203,13 +208,27 @@ func (bf *bloomFilter) String() string {
 	return header + base64.StdEncoding.EncodeToString(buf) + "\n"
 }
 
+func (bf *bloomFilter) Merge(other BloomFilter) error {
+	otherBf, ok := other.(*bloomFilter)
+	if !ok || otherBf == nil || len(otherBf.buffer) != len(bf.buffer) || otherBf.hashCount != bf.hashCount {
+		return ErrIncompatibleBloomFilter
+	}
+	for i := range bf.buffer {
+		bf.buffer[i] |= otherBf.buffer[i]
+	}
+	bf.bfElemCount += otherBf.bfElemCount
+	bf.computeHamming()
+
+	return nil
+}
+
 func (bf *bloomFilter) fold(times uint32) {
 	bfSize := len(bf.buffer)
 	for i := uint32(0); i < times; i++ {
 		for j := 0; j < bfSize/2; j++ {
 			bf.buffer[j] |= bf.buffer[j+(bfSize/2)]
 		}
-		bfSize >>= 2
+		bfSize >>= 1
 		if bfSize == 32 {
 			break
 		}
@@ -0,0 +1,519 @@
+// Package db implements a persistent store of similarity digests, which can be updated incrementally and searched for
+// the digests similar to a query.
+package db
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/eciavatta/sdhash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	logFileName   = "digests.log"
+	indexFileGlob = "batch-*.idx"
+)
+
+// DB is a collection of Sdbf stored in a directory, which can be looked up by name and compared to other Sdbf.
+// The records are appended to a log, and removed records are marked with a tombstone until the DB is compacted,
+// so adding and removing records doesn't require to rewrite the DB.
+// Each call to Add creates a batch of records, and the feature indexes of the Sdbf of the batch are merged in
+// a BloomFilter, which is saved in its own file. The index of the DB is rebuilt from the indexes of the batches.
+// A DB is safe for concurrent use by multiple goroutines, but it must not be opened by multiple processes.
+type DB interface {
+
+	// Add appends one or more records to the DB, as a new batch. Multiple records with the same name can be present
+	// in the same DB. If the Sdbf of the records have a feature index, returned by GetIndex, the indexes are merged
+	// and saved as the index of the batch.
+	Add(records ...Record) error
+
+	// Remove removes all the records with the specified name from the DB. Returns the number of records removed.
+	Remove(name string) (int, error)
+
+	// Lookup returns the first record in the DB with the specified name.
+	Lookup(name string) (Record, bool)
+
+	// Len returns the number of records in the DB.
+	Len() int
+
+	// Records returns a copy of the records in the DB, in insertion order.
+	Records() []Record
+
+	// Index returns a BloomFilter with the features of the records in the DB, built merging the indexes of the
+	// batches which contain at least a record. Since the elements of a BloomFilter can't be removed, the features
+	// of a removed record are still present until all the records of its batch are removed.
+	// If no batch has an index, nil is returned.
+	Index() (sdhash.BloomFilter, error)
+
+	// Query compares query to every record in the DB, and returns the k most similar Sdbf like sdhash.Set Query.
+	Query(query sdhash.Sdbf, k int) ([]sdhash.Result, error)
+
+	// Search compares query to every record in the DB, using Compare. The results with a score greater or equal than
+	// threshold are passed to f, in insertion order. If f returns an error, the search is stopped and the error
+	// is returned. The DB is locked during the search, so f must not modify it.
+	Search(query sdhash.Sdbf, threshold int, f sdhash.ResultFunc) error
+
+	// Compact rewrites the log of the DB without the removed records and their tombstones, and deletes the indexes
+	// of the batches which don't contain records anymore.
+	Compact() error
+
+	// Close closes the DB. The DB can't be used after it is closed.
+	Close() error
+}
+
+// Record is a Sdbf stored in a DB, with its metadata.
+type Record struct {
+	Sdbf     sdhash.Sdbf
+	Metadata map[string]string
+}
+
+type db struct {
+	dir       string
+	log       *os.File
+	records   []Record
+	batches   []uint32         // batch of each record
+	names     map[string][]int // positions of the records with the same name
+	set       sdhash.Set       // Sdbf of the records, used to compare them
+	nextBatch uint32
+	mutex     sync.RWMutex
+}
+
+// Open opens the DB stored in dir, creating the directory and an empty DB if they don't exist.
+// If the last write to the log was interrupted, the incomplete entry and the batch it belongs to are discarded.
+func Open(dir string) (DB, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	d := &db{
+		dir: dir,
+		set: sdhash.NewSet(nil),
+	}
+
+	logPath := filepath.Join(dir, logFileName)
+	log, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.replay(log); err != nil {
+		_ = log.Close()
+		return nil, fmt.Errorf("%s: %w", logPath, err)
+	}
+	d.log = log
+
+	return d, nil
+}
+
+// replay reads the log and rebuilds the records of the DB. An empty log is initialized with the log header.
+func (d *db) replay(log *os.File) error {
+	stat, err := log.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() == 0 {
+		if err := writeLogHeader(log); err != nil {
+			return err
+		}
+		d.reindex()
+		if err := log.Sync(); err != nil {
+			return err
+		}
+		return d.removeOrphanIndexes()
+	}
+
+	r := bufio.NewReader(log)
+	if err := readLogHeader(r); err != nil {
+		return err
+	}
+	var records, pending []Record // pending are the records of the batch not committed yet
+	var batches []uint32
+	var pendingBatch uint32
+	offset := int64(logHeaderSize)
+	committed := offset // end of the entries which are not part of an uncommitted batch
+	for {
+		e, n, err := readEntry(r, stat.Size()-offset)
+		if err == io.EOF {
+			break
+		} else if err == errTruncatedEntry || err == errInvalidChecksum {
+			// an interrupted write leaves an incomplete entry at the end of the log, and the entries following an
+			// invalid entry can't be found if its length is corrupted, so the log is truncated there
+			break
+		} else if err != nil {
+			return fmt.Errorf("entry at offset %d: %w", offset, err)
+		}
+
+		switch {
+		case e.kind == entryAdd && (len(pending) == 0 || e.batch == pendingBatch):
+			pending = append(pending, e.record)
+			pendingBatch = e.batch
+		case e.kind == entryCommit && len(pending) > 0 && e.batch == pendingBatch && e.count == uint32(len(pending)):
+			for _, record := range pending {
+				records = append(records, record)
+				batches = append(batches, e.batch)
+			}
+			pending = nil
+			if e.batch >= d.nextBatch {
+				d.nextBatch = e.batch + 1
+			}
+		case e.kind == entryRemove && len(pending) == 0:
+			records, batches = removeRecords(records, batches, e.name)
+		default:
+			return fmt.Errorf("entry at offset %d: invalid batch", offset)
+		}
+		offset += int64(n)
+		if len(pending) == 0 {
+			committed = offset
+		}
+	}
+	if committed < stat.Size() {
+		if err := log.Truncate(committed); err != nil {
+			return err
+		}
+	}
+	d.records, d.batches = records, batches
+	d.reindex()
+	d.set.Add(sdbfs(records)...)
+	if err := d.removeOrphanIndexes(); err != nil {
+		return err
+	}
+
+	_, err = log.Seek(committed, io.SeekStart)
+	return err
+}
+
+func (d *db) Add(records ...Record) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.log == nil {
+		return os.ErrClosed
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	batch := d.nextBatch
+	var index sdhash.BloomFilter
+	for _, record := range records {
+		if record.Sdbf == nil {
+			return errors.New("record without sdbf")
+		}
+		recordIndex := record.Sdbf.GetIndex()
+		if recordIndex == nil {
+			continue
+		}
+		if index == nil {
+			index = sdhash.NewBloomFilter()
+		}
+		if err := index.Merge(recordIndex); err != nil {
+			return fmt.Errorf("%s: %w", record.Sdbf.Name(), err)
+		}
+	}
+
+	buf, err := encodeBatch(batch, records)
+	if err != nil {
+		return err
+	}
+	// the index is written before the records, so the records of a batch never miss their index, and it is removed
+	// if the records are not written, so a later batch with the same number doesn't get its features. If the DB is
+	// interrupted before the records are written, the index is removed when the DB is opened again.
+	if index != nil {
+		if err := index.WriteToFile(d.indexPath(batch)); err != nil {
+			_ = os.Remove(d.indexPath(batch))
+			return err
+		}
+	}
+	if err := d.append(buf); err != nil {
+		if index != nil {
+			_ = os.Remove(d.indexPath(batch))
+		}
+		return err
+	}
+
+	d.nextBatch++
+	for _, record := range records {
+		d.names[record.Sdbf.Name()] = append(d.names[record.Sdbf.Name()], len(d.records))
+		d.records = append(d.records, record)
+		d.batches = append(d.batches, batch)
+	}
+	d.set.Add(sdbfs(records)...)
+
+	return nil
+}
+
+func (d *db) Remove(name string) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.log == nil {
+		return 0, os.ErrClosed
+	}
+	removed := len(d.names[name])
+	if removed == 0 {
+		return 0, nil
+	}
+	data, err := encodeEntry(entry{kind: entryRemove, name: name})
+	if err != nil {
+		return 0, err
+	}
+	if err := d.append(data); err != nil {
+		return 0, err
+	}
+	d.records, d.batches = removeRecords(d.records, d.batches, name)
+	d.reindex()
+	d.set.Remove(name)
+
+	return removed, nil
+}
+
+func (d *db) Lookup(name string) (Record, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if positions := d.names[name]; len(positions) > 0 {
+		return d.records[positions[0]], true
+	}
+	return Record{}, false
+}
+
+func (d *db) Len() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return len(d.records)
+}
+
+func (d *db) Records() []Record {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	records := make([]Record, len(d.records))
+	copy(records, d.records)
+	return records
+}
+
+func (d *db) Index() (sdhash.BloomFilter, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	var index sdhash.BloomFilter
+	for _, batch := range d.liveBatches() {
+		batchIndex, err := sdhash.NewBloomFilterFromIndexFile(d.indexPath(batch))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if index == nil {
+			index = batchIndex
+		} else if err := index.Merge(batchIndex); err != nil {
+			return nil, err
+		}
+	}
+
+	return index, nil
+}
+
+func (d *db) Query(query sdhash.Sdbf, k int) ([]sdhash.Result, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if d.log == nil {
+		return nil, os.ErrClosed
+	}
+	return d.set.Query(query, k)
+}
+
+func (d *db) Search(query sdhash.Sdbf, threshold int, f sdhash.ResultFunc) error {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if d.log == nil {
+		return os.ErrClosed
+	}
+	queries := sdhash.NewSet(nil)
+	queries.Add(query)
+	return queries.CompareTo(d.set, threshold, 0, sdhash.DefaultSeed, f)
+}
+
+func (d *db) Compact() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.log == nil {
+		return os.ErrClosed
+	}
+
+	logPath := filepath.Join(d.dir, logFileName)
+	tmpPath := logPath + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	err = writeLogHeader(w)
+	// the records of a batch are consecutive, since they are added together
+	for start, end := 0, 0; start < len(d.records) && err == nil; start = end {
+		for end = start + 1; end < len(d.records) && d.batches[end] == d.batches[start]; end++ {
+		}
+		var data []uint8
+		if data, err = encodeBatch(d.batches[start], d.records[start:end]); err == nil {
+			_, err = w.Write(data)
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, logPath)
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	_ = d.log.Close()
+	if d.log, err = os.OpenFile(logPath, os.O_RDWR, 0644); err != nil {
+		return err
+	}
+	if _, err = d.log.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+
+	return d.removeUnusedIndexes()
+}
+
+func (d *db) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.log == nil {
+		return os.ErrClosed
+	}
+	err := d.log.Close()
+	d.log = nil
+	return err
+}
+
+// append writes data at the end of the log, and waits until it is stored. If the write fails, the log is truncated
+// back to its previous size, so it never contains an incomplete entry.
+func (d *db) append(data []uint8) error {
+	offset, err := d.log.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = d.log.Write(data); err == nil {
+		err = d.log.Sync()
+	}
+	if err != nil {
+		if truncateErr := d.log.Truncate(offset); truncateErr != nil {
+			return fmt.Errorf("%w (failed to restore the log: %v)", err, truncateErr)
+		}
+		if _, seekErr := d.log.Seek(offset, io.SeekStart); seekErr != nil {
+			return fmt.Errorf("%w (failed to restore the log: %v)", err, seekErr)
+		}
+	}
+	return err
+}
+
+// reindex rebuilds the positions of the records with the same name.
+func (d *db) reindex() {
+	d.names = make(map[string][]int, len(d.records))
+	for i, record := range d.records {
+		d.names[record.Sdbf.Name()] = append(d.names[record.Sdbf.Name()], i)
+	}
+}
+
+// liveBatches returns the sorted batches which contain at least a record.
+func (d *db) liveBatches() []uint32 {
+	seen := make(map[uint32]bool)
+	var batches []uint32
+	for _, batch := range d.batches {
+		if !seen[batch] {
+			seen[batch] = true
+			batches = append(batches, batch)
+		}
+	}
+	sort.Slice(batches, func(i, j int) bool {
+		return batches[i] < batches[j]
+	})
+	return batches
+}
+
+// removeUnusedIndexes deletes the index files of the batches without records.
+func (d *db) removeUnusedIndexes() error {
+	live := make(map[string]bool)
+	for _, batch := range d.liveBatches() {
+		live[d.indexPath(batch)] = true
+	}
+	indexPaths, err := filepath.Glob(filepath.Join(d.dir, indexFileGlob))
+	if err != nil {
+		return err
+	}
+	for _, indexPath := range indexPaths {
+		if !live[indexPath] {
+			if err := os.Remove(indexPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeOrphanIndexes deletes the index files of the batches which are not in the log, as when the DB is interrupted
+// after the index of a batch is written but before its records are, so the number of the batch can be reused.
+func (d *db) removeOrphanIndexes() error {
+	indexPaths, err := filepath.Glob(filepath.Join(d.dir, indexFileGlob))
+	if err != nil {
+		return err
+	}
+	for _, indexPath := range indexPaths {
+		var batch uint32
+		if _, err := fmt.Sscanf(filepath.Base(indexPath), "batch-%d.idx", &batch); err != nil {
+			continue
+		}
+		if batch >= d.nextBatch {
+			if err := os.Remove(indexPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexPath returns the path of the index file of a batch.
+func (d *db) indexPath(batch uint32) string {
+	return filepath.Join(d.dir, fmt.Sprintf("batch-%08d.idx", batch))
+}
+
+// removeRecords returns the records, with their batches, whose Sdbf name is not name.
+func removeRecords(records []Record, batches []uint32, name string) ([]Record, []uint32) {
+	keptRecords := make([]Record, 0, len(records))
+	keptBatches := make([]uint32, 0, len(batches))
+	for i, record := range records {
+		if record.Sdbf.Name() != name {
+			keptRecords = append(keptRecords, record)
+			keptBatches = append(keptBatches, batches[i])
+		}
+	}
+	return keptRecords, keptBatches
+}
+
+// sdbfs returns the Sdbf of the records.
+func sdbfs(records []Record) []sdhash.Sdbf {
+	sdbfs := make([]sdhash.Sdbf, len(records))
+	for i, record := range records {
+		sdbfs[i] = record.Sdbf
+	}
+	return sdbfs
+}
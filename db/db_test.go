@@ -0,0 +1,324 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/eciavatta/sdhash"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const kB = 1024
+
+// newTestSdbfs digests n overlapping windows of random data, so that consecutive digests are similar.
+func newTestSdbfs(t *testing.T, n int) []sdhash.Sdbf {
+	buf := make([]uint8, (n+3)*64*kB)
+	_, err := rand.New(rand.NewSource(int64(n))).Read(buf)
+	require.NoError(t, err)
+
+	sdbfs := make([]sdhash.Sdbf, n)
+	for i := range sdbfs {
+		factory, err := sdhash.CreateSdbfFromBytes(buf[i*64*kB : (i+4)*64*kB])
+		require.NoError(t, err)
+		sdbfs[i], err = factory.WithName(fmt.Sprintf("sdbf-%d", i)).Compute()
+		require.NoError(t, err)
+	}
+	return sdbfs
+}
+
+func names(records []Record) []string {
+	var names []string
+	for _, record := range records {
+		names = append(names, record.Sdbf.Name())
+	}
+	return names
+}
+
+func TestDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdhash-db-test")
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	sdbfs := newTestSdbfs(t, 6)
+
+	d, err := Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, d.Add(Record{Sdbf: sdbfs[0], Metadata: map[string]string{"path": "/a", "case": "1"}},
+		Record{Sdbf: sdbfs[1]}))
+	require.NoError(t, d.Add(Record{Sdbf: sdbfs[2]}, Record{Sdbf: sdbfs[3]}))
+	parsed, err := sdhash.ParseSdbfFromString(sdbfs[4].String())
+	require.NoError(t, err)
+	require.NoError(t, d.Add(Record{Sdbf: parsed}))
+	assert.Equal(t, 5, d.Len())
+
+	removed, err := d.Remove("sdbf-1")
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	removed, err = d.Remove("sdbf-1")
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+	removed, err = d.Remove("sdbf-4")
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	expected := []string{"sdbf-0", "sdbf-2", "sdbf-3"}
+	assert.Equal(t, expected, names(d.Records()))
+	require.NoError(t, d.Close())
+
+	d, err = Open(dir)
+	require.NoError(t, err)
+	assert.Equal(t, expected, names(d.Records()))
+	record, ok := d.Lookup("sdbf-0")
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{"path": "/a", "case": "1"}, record.Metadata)
+	assert.Equal(t, sdbfs[0].String(), record.Sdbf.String())
+	_, ok = d.Lookup("sdbf-1")
+	assert.False(t, ok)
+
+	results, err := d.Query(sdbfs[2], 2)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, "sdbf-2", results[0].Target.Name())
+	assert.Equal(t, 100, results[0].Score)
+	var searchResults []sdhash.Result
+	require.NoError(t, d.Search(sdbfs[1], 1, sdhash.CollectResults(&searchResults)))
+	for _, result := range searchResults {
+		score, err := sdbfs[1].Compare(result.Target)
+		require.NoError(t, err)
+		assert.Equal(t, score, result.Score)
+	}
+	assert.NotEmpty(t, searchResults)
+
+	index, err := d.Index()
+	require.NoError(t, err)
+	require.NotNil(t, index)
+	assert.Equal(t, sdbfs[0].GetIndex().ElemCount()+sdbfs[1].GetIndex().ElemCount()+
+		sdbfs[2].GetIndex().ElemCount()+sdbfs[3].GetIndex().ElemCount(), index.ElemCount())
+
+	logSize := func() int64 {
+		stat, err := os.Stat(filepath.Join(dir, logFileName))
+		require.NoError(t, err)
+		return stat.Size()
+	}
+	sizeBefore := logSize()
+	require.NoError(t, d.Compact())
+	assert.True(t, logSize() < sizeBefore)
+	assert.Equal(t, expected, names(d.Records()))
+	indexes, err := filepath.Glob(filepath.Join(dir, indexFileGlob))
+	require.NoError(t, err)
+	assert.Len(t, indexes, 2)
+
+	removed, err = d.Remove("sdbf-0")
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	require.NoError(t, d.Compact())
+	index, err = d.Index()
+	require.NoError(t, err)
+	assert.Equal(t, sdbfs[2].GetIndex().ElemCount()+sdbfs[3].GetIndex().ElemCount(), index.ElemCount())
+	require.NoError(t, d.Add(Record{Sdbf: sdbfs[5]}))
+	require.NoError(t, d.Close())
+	assert.Equal(t, os.ErrClosed, d.Close())
+	_, err = d.Query(sdbfs[0], 1)
+	assert.Equal(t, os.ErrClosed, err)
+	assert.Equal(t, os.ErrClosed, d.Search(sdbfs[0], 0, func(sdhash.Result) error { return nil }))
+
+	d, err = Open(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sdbf-2", "sdbf-3", "sdbf-5"}, names(d.Records()))
+	require.NoError(t, d.Close())
+}
+
+func TestTruncatedLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdhash-db-test")
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	sdbfs := newTestSdbfs(t, 2)
+
+	d, err := Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, d.Add(Record{Sdbf: sdbfs[0]}))
+	require.NoError(t, d.Add(Record{Sdbf: sdbfs[1]}))
+	require.NoError(t, d.Close())
+
+	// simulate an interrupted write of the last entry
+	logPath := filepath.Join(dir, logFileName)
+	stat, err := os.Stat(logPath)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(logPath, stat.Size()-10))
+
+	d, err = Open(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sdbf-0"}, names(d.Records()))
+	stat, err = os.Stat(logPath)
+	require.NoError(t, err)
+	firstBatchEnd := int(stat.Size())
+	require.NoError(t, d.Add(Record{Sdbf: sdbfs[1]}))
+	require.NoError(t, d.Close())
+
+	d, err = Open(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sdbf-0", "sdbf-1"}, names(d.Records()))
+	require.NoError(t, d.Close())
+
+	// the length of an incomplete entry is checked against the size of the log before reading the entry
+	data, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(logPath, append(data, entryAdd, 0xFF, 0xFF, 0xFF, 0xFF), 0644))
+	d, err = Open(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sdbf-0", "sdbf-1"}, names(d.Records()))
+	require.NoError(t, d.Close())
+	stat, err = os.Stat(logPath)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), stat.Size())
+
+	// the log is truncated at the first entry with a corrupted length or checksum, with the batch it belongs to
+	for _, corrupted := range []int{logHeaderSize + entryHeadSize - 1, logHeaderSize + entryHeadSize,
+		firstBatchEnd + entryHeadSize - 1, len(data) - 1} {
+		data[corrupted] ^= 0x7F
+		require.NoError(t, ioutil.WriteFile(logPath, data, 0644))
+		data[corrupted] ^= 0x7F
+		d, err = Open(dir)
+		require.NoError(t, err)
+		expected, expectedSize := []string(nil), int64(logHeaderSize)
+		if corrupted > firstBatchEnd {
+			expected, expectedSize = []string{"sdbf-0"}, int64(firstBatchEnd)
+		}
+		assert.Equal(t, expected, names(d.Records()), "byte %d", corrupted)
+		require.NoError(t, d.Close())
+		stat, err = os.Stat(logPath)
+		require.NoError(t, err)
+		assert.Equal(t, expectedSize, stat.Size(), "byte %d", corrupted)
+	}
+
+	// a complete entry which doesn't belong to the pending batch is not mistaken for an interrupted write
+	removeData, err := encodeEntry(entry{kind: entryRemove, name: "sdbf-0"})
+	require.NoError(t, err)
+	commitOffset := firstBatchEnd - (entryHeadSize + 8 + entrySumSize)
+	require.NoError(t, ioutil.WriteFile(logPath, append(append([]uint8{}, data[:commitOffset]...), removeData...), 0644))
+	_, err = Open(dir)
+	assert.EqualError(t, err, fmt.Sprintf("%s: entry at offset %d: invalid batch", logPath, commitOffset))
+}
+
+func TestFailedAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdhash-db-test")
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	sdbfs := newTestSdbfs(t, 1)
+	require.NotNil(t, sdbfs[0].GetIndex())
+
+	d, err := Open(dir)
+	require.NoError(t, err)
+	// the index of a batch whose records are not written is removed
+	require.NoError(t, d.(*db).log.Close())
+	assert.Error(t, d.Add(Record{Sdbf: sdbfs[0]}))
+	_, err = os.Stat(d.(*db).indexPath(0))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, 0, d.Len())
+}
+
+func TestEntryMetadataCount(t *testing.T) {
+	sdbfs := newTestSdbfs(t, 1)
+	data, err := encodeEntry(entry{kind: entryAdd, record: Record{Sdbf: sdbfs[0], Metadata: map[string]string{"a": "b"}}})
+	require.NoError(t, err)
+	e, n, err := readEntry(bufio.NewReader(bytes.NewReader(data)), int64(len(data)))
+	require.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.Equal(t, map[string]string{"a": "b"}, e.record.Metadata)
+
+	binary.LittleEndian.PutUint32(data[entryHeadSize+4:], 0xFFFFFFFF)
+	sumOffset := len(data) - entrySumSize
+	binary.LittleEndian.PutUint32(data[sumOffset:], crc32.ChecksumIEEE(data[:sumOffset]))
+	_, _, err = readEntry(bufio.NewReader(bytes.NewReader(data)), int64(len(data)))
+	assert.EqualError(t, err, "invalid metadata count")
+}
+
+func TestInterruptedBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdhash-db-test")
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	sdbfs := newTestSdbfs(t, 3)
+
+	d, err := Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, d.Add(Record{Sdbf: sdbfs[0]}))
+	require.NoError(t, d.Close())
+	logPath := filepath.Join(dir, logFileName)
+	committed, err := ioutil.ReadFile(logPath)
+	require.NoError(t, err)
+
+	// simulate an interruption after the first record of a batch is written, but before the second one and the commit
+	batch, err := encodeBatch(1, []Record{{Sdbf: sdbfs[1]}, {Sdbf: sdbfs[2]}})
+	require.NoError(t, err)
+	first, err := encodeEntry(entry{kind: entryAdd, batch: 1, record: Record{Sdbf: sdbfs[1]}})
+	require.NoError(t, err)
+	require.Equal(t, first, batch[:len(first)])
+	for _, size := range []int{len(first), len(batch) - 1} {
+		require.NoError(t, ioutil.WriteFile(logPath, append(append([]uint8{}, committed...), batch[:size]...), 0644))
+		d, err = Open(dir)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"sdbf-0"}, names(d.Records()), "%d bytes of the batch", size)
+		require.NoError(t, d.Close())
+		stat, err := os.Stat(logPath)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(committed)), stat.Size())
+	}
+
+	require.NoError(t, ioutil.WriteFile(logPath, append(append([]uint8{}, committed...), batch...), 0644))
+	d, err = Open(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sdbf-0", "sdbf-1", "sdbf-2"}, names(d.Records()))
+	require.NoError(t, d.Compact())
+	require.NoError(t, d.Close())
+	d, err = Open(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"sdbf-0", "sdbf-1", "sdbf-2"}, names(d.Records()))
+	require.NoError(t, d.Close())
+}
+
+func TestOrphanIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sdhash-db-test")
+	require.NoError(t, err)
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	sdbfs := newTestSdbfs(t, 2)
+
+	d, err := Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, d.Add(Record{Sdbf: sdbfs[0]}))
+	// simulate an interruption after the index of the next batch is written, but before its records are
+	orphanPath := d.(*db).indexPath(1)
+	require.NoError(t, sdbfs[1].GetIndex().WriteToFile(orphanPath))
+	require.NoError(t, d.Close())
+
+	d, err = Open(dir)
+	require.NoError(t, err)
+	_, err = os.Stat(orphanPath)
+	assert.True(t, os.IsNotExist(err))
+	// a later batch with the same number and without an index doesn't get the features of the orphan index
+	withoutIndex, err := sdhash.ParseSdbfFromString(sdbfs[1].String())
+	require.NoError(t, err)
+	require.NoError(t, d.Add(Record{Sdbf: withoutIndex}))
+	index, err := d.Index()
+	require.NoError(t, err)
+	// the encoding of an index is not deterministic, so the features are compared by their count
+	assert.Equal(t, sdbfs[0].GetIndex().ElemCount(), index.ElemCount())
+	_, err = os.Stat(orphanPath)
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, d.Close())
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/eciavatta/sdhash"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+// The log of a DB is composed by a header followed by a sequence of entries:
+//
+//	header:  magic (6 bytes) | version (1 byte)
+//	entry:   type (1 byte) | payload length (uint32) | payload | crc32 of all the previous bytes of the entry (uint32)
+//
+// The payload of an entryAdd contains, in order: the batch of the record (uint32), the metadata count (uint32),
+// the length (uint32) and the bytes of each metadata key and value, sorted by key, and finally the binary encoding
+// of the Sdbf. The payload of an entryRemove contains the name of the records to remove. The entries of the records
+// of a batch are followed by an entryCommit, whose payload contains the batch (uint32) and the number of its records
+// (uint32), so a batch whose write was interrupted is discarded as a whole. All integers are little endian.
+const (
+	logMagic      = "SDBFDB"
+	logVersion    = 1
+	logHeaderSize = len(logMagic) + 1
+	entryHeadSize = 1 + 4
+	entrySumSize  = 4
+
+	entryAdd    = 0x01
+	entryRemove = 0x02
+	entryCommit = 0x03
+)
+
+var (
+	// errTruncatedEntry is returned when the last entry of the log is incomplete, as when a write was interrupted.
+	errTruncatedEntry = errors.New("truncated entry")
+	// errInvalidChecksum is returned when the checksum of an entry doesn't match its bytes.
+	errInvalidChecksum = errors.New("invalid entry checksum")
+)
+
+// entry is an operation recorded in the log.
+type entry struct {
+	kind   uint8
+	batch  uint32 // batch of the added record or of the commit
+	count  uint32 // number of records of the committed batch
+	record Record // added record
+	name   string // name of the removed records
+}
+
+// writeLogHeader writes the header of a new log.
+func writeLogHeader(w io.Writer) error {
+	_, err := w.Write(append([]uint8(logMagic), logVersion))
+	return err
+}
+
+// readLogHeader reads and checks the header of a log.
+func readLogHeader(r io.Reader) error {
+	header := make([]uint8, logHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return errors.New("failed to read log header")
+	}
+	if string(header[:len(logMagic)]) != logMagic {
+		return errors.New("invalid log magic")
+	}
+	if header[len(logMagic)] != logVersion {
+		return errors.New("unsupported log version")
+	}
+	return nil
+}
+
+// encodeEntry returns the encoding of an entry.
+func encodeEntry(e entry) ([]uint8, error) {
+	var payload bytes.Buffer
+	switch e.kind {
+	case entryAdd:
+		digest, err := e.record.Sdbf.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(e.record.Metadata))
+		for key := range e.record.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		_ = binary.Write(&payload, binary.LittleEndian, [2]uint32{e.batch, uint32(len(keys))})
+		for _, key := range keys {
+			writeString(&payload, key)
+			writeString(&payload, e.record.Metadata[key])
+		}
+		payload.Write(digest)
+	case entryRemove:
+		payload.WriteString(e.name)
+	case entryCommit:
+		_ = binary.Write(&payload, binary.LittleEndian, [2]uint32{e.batch, e.count})
+	default:
+		return nil, errors.New("invalid entry type")
+	}
+
+	buf := bytes.NewBuffer(make([]uint8, 0, entryHeadSize+payload.Len()+entrySumSize))
+	buf.WriteByte(e.kind)
+	_ = binary.Write(buf, binary.LittleEndian, uint32(payload.Len()))
+	buf.Write(payload.Bytes())
+	_ = binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	return buf.Bytes(), nil
+}
+
+// encodeBatch returns the encoding of the entries which add records to the log as batch, followed by their commit.
+func encodeBatch(batch uint32, records []Record) ([]uint8, error) {
+	var buf []uint8
+	for _, record := range records {
+		data, err := encodeEntry(entry{kind: entryAdd, batch: batch, record: record})
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, data...)
+	}
+	data, err := encodeEntry(entry{kind: entryCommit, batch: batch, count: uint32(len(records))})
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, data...), nil
+}
+
+// readEntry reads the next entry of the log, which has remaining bytes left, and returns it with the length of its
+// encoding. If there are no more entries, readEntry returns io.EOF. If the entry is incomplete, because it extends
+// past the end of the log, errTruncatedEntry is returned, and if its checksum doesn't match errInvalidChecksum is.
+func readEntry(r *bufio.Reader, remaining int64) (entry, int, error) {
+	head := make([]uint8, entryHeadSize)
+	if _, err := io.ReadFull(r, head); err == io.EOF {
+		return entry{}, 0, io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		return entry{}, 0, errTruncatedEntry
+	} else if err != nil {
+		return entry{}, 0, err
+	}
+	// the size is checked before allocating the entry, so a corrupted header can't cause a huge allocation
+	entrySize := int64(entryHeadSize) + int64(binary.LittleEndian.Uint32(head[1:])) + entrySumSize
+	if entrySize > remaining {
+		return entry{}, 0, errTruncatedEntry
+	}
+	data := make([]uint8, entrySize)
+	copy(data, head)
+	if _, err := io.ReadFull(r, data[entryHeadSize:]); err == io.ErrUnexpectedEOF || err == io.EOF {
+		return entry{}, 0, errTruncatedEntry
+	} else if err != nil {
+		return entry{}, 0, err
+	}
+	sumOffset := len(data) - entrySumSize
+	if crc32.ChecksumIEEE(data[:sumOffset]) != binary.LittleEndian.Uint32(data[sumOffset:]) {
+		return entry{}, 0, errInvalidChecksum
+	}
+
+	e := entry{kind: head[0]}
+	payload := bytes.NewReader(data[entryHeadSize:sumOffset])
+	switch e.kind {
+	case entryAdd:
+		var counts [2]uint32
+		if err := binary.Read(payload, binary.LittleEndian, &counts); err != nil {
+			return entry{}, 0, errors.New("failed to read entry batch")
+		}
+		e.batch = counts[0]
+		// each metadata key and value is preceded by its length, so the count is checked before allocating the map
+		if uint64(counts[1]) > uint64(payload.Len()/8) {
+			return entry{}, 0, errors.New("invalid metadata count")
+		}
+		e.record.Metadata = make(map[string]string, counts[1])
+		for i := uint32(0); i < counts[1]; i++ {
+			key, err := readString(payload)
+			if err != nil {
+				return entry{}, 0, errors.New("failed to read metadata key")
+			}
+			if e.record.Metadata[key], err = readString(payload); err != nil {
+				return entry{}, 0, errors.New("failed to read metadata value")
+			}
+		}
+		digest := make([]uint8, payload.Len())
+		_, _ = payload.Read(digest)
+		var err error
+		if e.record.Sdbf, err = sdhash.ParseSdbfFromBytes(digest); err != nil {
+			return entry{}, 0, err
+		}
+	case entryRemove:
+		e.name = string(data[entryHeadSize:sumOffset])
+	case entryCommit:
+		var commit [2]uint32
+		if payload.Len() != binary.Size(commit) {
+			return entry{}, 0, errors.New("invalid commit entry")
+		}
+		_ = binary.Read(payload, binary.LittleEndian, &commit)
+		e.batch, e.count = commit[0], commit[1]
+	default:
+		return entry{}, 0, errors.New("invalid entry type")
+	}
+
+	return e, len(data), nil
+}
+
+// writeString writes the length of s followed by its bytes.
+func writeString(buf *bytes.Buffer, s string) {
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+// readString reads a string written by writeString.
+func readString(r *bytes.Reader) (string, error) {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return "", err
+	}
+	if int(length) > r.Len() {
+		return "", io.ErrUnexpectedEOF
+	}
+	s := make([]uint8, length)
+	_, _ = r.Read(s)
+	return string(s), nil
+}
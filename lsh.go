@@ -0,0 +1,226 @@
+package sdhash
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// LSHIndex is a locality-sensitive index of the bloom filters of many Sdbf, which can be used to find the Sdbf that
+// are likely similar to a query without comparing the query to all of them. Each filter is summarized by MinHash
+// values of its set bits, which are grouped in bands: two filters are candidates if all the values of at least a band
+// are equal. The probability of a filter to be a candidate grows with the Jaccard similarity of the set bits of the
+// two filters: with more rows per band the unrelated filters are less likely candidates, with more bands the similar
+// filters are more likely candidates. Recall can be measured against brute force comparisons with Recall.
+// A LSHIndex is safe for concurrent use by multiple goroutines.
+type LSHIndex interface {
+
+	// Add indexes the filters of one or more Sdbf. The filters with too few elements to be compared are not indexed.
+	// It returns ErrIncompatibleDigest if a Sdbf was not created by this package.
+	Add(sdbfs ...Sdbf) error
+
+	// Len returns the number of Sdbf in the LSHIndex.
+	Len() int
+
+	// Candidates returns the Sdbf with at least a filter in the same bucket of a filter of query,
+	// in insertion order.
+	Candidates(query Sdbf) ([]Sdbf, error)
+
+	// Query compares query to the candidates returned by Candidates, and returns the k most similar Sdbf sorted by
+	// descending score, like Set Query. The results are the same of Set Query if all the Sdbf similar to the query
+	// are candidates.
+	Query(query Sdbf, k int) ([]Result, error)
+
+	// Recall compares each query to every Sdbf in the LSHIndex, and returns the fraction of the Sdbf with a score
+	// greater or equal than threshold which are returned by Candidates. If no Sdbf has a score greater or equal than
+	// threshold, 1 is returned.
+	Recall(queries []Sdbf, threshold int) (float64, error)
+}
+
+// LSHParams contains the parameters of a LSHIndex.
+type LSHParams struct {
+	Bands int   // Bands is the number of bands of MinHash values of each filter.
+	Rows  int   // Rows is the number of MinHash values in each band.
+	Seed  int64 // Seed is used to generate the permutations of the MinHash functions.
+}
+
+// DefaultLSHParams returns the parameters used by default by a LSHIndex.
+func DefaultLSHParams() LSHParams {
+	return LSHParams{
+		Bands: 32,
+		Rows:  8,
+		Seed:  DefaultSeed,
+	}
+}
+
+type lshIndex struct {
+	params  LSHParams
+	perms   [][]uint16            // permutation of the bits of a filter for each MinHash function
+	buckets []map[uint64][]uint32 // positions of the Sdbf for each band key, for each band
+	sdbfs   []Sdbf
+	mutex   sync.RWMutex
+}
+
+// NewLSHIndex creates an empty LSHIndex. It returns ErrInvalidParams if the number of bands or rows is not positive.
+func NewLSHIndex(params LSHParams) (LSHIndex, error) {
+	if params.Bands <= 0 || params.Rows <= 0 {
+		return nil, fmt.Errorf("%w: bands and rows must be greater than 0", ErrInvalidParams)
+	}
+
+	bfBits := int(DefaultParams().BfSize) * 8
+	r := rand.New(rand.NewSource(params.Seed))
+	perms := make([][]uint16, params.Bands*params.Rows)
+	for i := range perms {
+		perms[i] = make([]uint16, bfBits)
+		for j, bit := range r.Perm(bfBits) {
+			perms[i][j] = uint16(bit)
+		}
+	}
+	buckets := make([]map[uint64][]uint32, params.Bands)
+	for i := range buckets {
+		buckets[i] = make(map[uint64][]uint32)
+	}
+
+	return &lshIndex{
+		params:  params,
+		perms:   perms,
+		buckets: buckets,
+		sdbfs:   make([]Sdbf, 0),
+	}, nil
+}
+
+func (idx *lshIndex) Add(sdbfs ...Sdbf) error {
+	for _, sd := range sdbfs {
+		if _, ok := sd.(*sdbf); !ok || sd.(*sdbf) == nil {
+			return ErrIncompatibleDigest
+		}
+	}
+
+	idx.mutex.Lock()
+	defer idx.mutex.Unlock()
+
+	keys := make([]uint64, idx.params.Bands)
+	for _, sd := range sdbfs {
+		position := uint32(len(idx.sdbfs))
+		idx.sdbfs = append(idx.sdbfs, sd)
+		sd := sd.(*sdbf)
+		for i := uint32(0); i < sd.bfCount; i++ {
+			if !idx.bandKeys(sd, i, keys) {
+				continue
+			}
+			for band, key := range keys {
+				bucket := idx.buckets[band][key]
+				if len(bucket) == 0 || bucket[len(bucket)-1] != position {
+					idx.buckets[band][key] = append(bucket, position)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (idx *lshIndex) Len() int {
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	return len(idx.sdbfs)
+}
+
+func (idx *lshIndex) Candidates(query Sdbf) ([]Sdbf, error) {
+	querySd, ok := query.(*sdbf)
+	if !ok || querySd == nil {
+		return nil, ErrIncompatibleDigest
+	}
+
+	idx.mutex.RLock()
+	defer idx.mutex.RUnlock()
+
+	found := make([]bool, len(idx.sdbfs))
+	keys := make([]uint64, idx.params.Bands)
+	for i := uint32(0); i < querySd.bfCount; i++ {
+		if !idx.bandKeys(querySd, i, keys) {
+			continue
+		}
+		for band, key := range keys {
+			for _, position := range idx.buckets[band][key] {
+				found[position] = true
+			}
+		}
+	}
+
+	candidates := make([]Sdbf, 0)
+	for position, isCandidate := range found {
+		if isCandidate {
+			candidates = append(candidates, idx.sdbfs[position])
+		}
+	}
+	return candidates, nil
+}
+
+func (idx *lshIndex) Query(query Sdbf, k int) ([]Result, error) {
+	candidates, err := idx.Candidates(query)
+	if err != nil {
+		return nil, err
+	}
+	s := NewSet(nil)
+	s.Add(candidates...)
+	return s.Query(query, k)
+}
+
+func (idx *lshIndex) Recall(queries []Sdbf, threshold int) (float64, error) {
+	idx.mutex.RLock()
+	sdbfs := make([]Sdbf, len(idx.sdbfs))
+	copy(sdbfs, idx.sdbfs)
+	idx.mutex.RUnlock()
+
+	var relevant, found int
+	for _, query := range queries {
+		candidates, err := idx.Candidates(query)
+		if err != nil {
+			return 0, err
+		}
+		isCandidate := make(map[Sdbf]bool, len(candidates))
+		for _, candidate := range candidates {
+			isCandidate[candidate] = true
+		}
+		for _, sd := range sdbfs {
+			score, err := compareThreshold(query, sd, threshold, 0, DefaultSeed)
+			if err != nil {
+				return 0, err
+			}
+			if score >= threshold {
+				relevant++
+				if isCandidate[sd] {
+					found++
+				}
+			}
+		}
+	}
+
+	if relevant == 0 {
+		return 1, nil
+	}
+	return float64(found) / float64(relevant), nil
+}
+
+// bandKeys calculates the key of each band of the filter at index of sd. The MinHash value of a permutation is the
+// position in the permutation of the first bit set in the filter. It returns false if the filter has too few elements
+// to be compared.
+func (idx *lshIndex) bandKeys(sd *sdbf, index uint32, keys []uint64) bool {
+	if sd.getElemCount(uint64(index)) < minElemCount || sd.hamming[index] == 0 {
+		return false
+	}
+	filter := sd.buffer[index*sd.bfSize : (index+1)*sd.bfSize]
+	for band := range keys {
+		var key uint64 = 14695981039346656037 // FNV-1a offset basis
+		for _, perm := range idx.perms[band*idx.params.Rows : (band+1)*idx.params.Rows] {
+			var minHash int
+			for minHash = 0; filter[perm[minHash]>>3]&bits[perm[minHash]&0x7] == 0; minHash++ {
+			}
+			key = (key ^ uint64(minHash)) * 1099511628211 // FNV-1a prime
+		}
+		keys[band] = key
+	}
+	return true
+}
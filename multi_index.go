@@ -0,0 +1,127 @@
+package sdhash
+
+import (
+	bits2 "math/bits"
+)
+
+// MultiIndex is a set of BloomFilter which are checked for similarity during the digesting process, and it can be
+// used as search indexes in place of a list of BloomFilter with WithSearchMultiIndex.
+// A MultiIndex created by NewMultiIndex is a bit-sliced signature file: the bits at the same position of all the
+// BloomFilter are stored contiguously, so a feature is searched in all the BloomFilter with a single probe for each
+// hash function, instead of a probe for each hash function of each BloomFilter.
+// A MultiIndex is safe for concurrent use by multiple goroutines.
+type MultiIndex interface {
+
+	// Len returns the number of BloomFilter in the MultiIndex.
+	Len() int
+
+	// searchSha1 increments the element of matches of each BloomFilter which contains the feature sha1.
+	// It returns true if at least a BloomFilter contains the feature.
+	searchSha1(sha1 []uint32, matches []uint32) bool
+}
+
+// bloomFilterList is a MultiIndex which probes each BloomFilter one after another.
+type bloomFilterList []BloomFilter
+
+func (l bloomFilterList) Len() int {
+	return len(l)
+}
+
+func (l bloomFilterList) searchSha1(sha1 []uint32, matches []uint32) bool {
+	any := false
+
+	for i := 0; i < len(l); i++ {
+		if l[i].querySha1(sha1) {
+			matches[i]++
+			any = true
+		}
+	}
+
+	return any
+}
+
+type bitSlicedIndex struct {
+	words     []uint64 // bits of each position of the BloomFilter, filterCount bits for each position
+	count     uint64   // number of BloomFilter
+	bitMask   uint64   // bit mask of the BloomFilter
+	hashCount uint16   // number of hash functions of the BloomFilter
+}
+
+// NewMultiIndex creates a bit-sliced MultiIndex of indexes. The results of the searches are identical to the results
+// of the searches in the list of BloomFilter, and the order of indexes is preserved in the results.
+// All the BloomFilter must have the same size and the same number of hash functions, otherwise
+// ErrIncompatibleBloomFilter is returned. The MultiIndex doesn't reference indexes, which can be modified
+// or discarded after its creation.
+func NewMultiIndex(indexes []BloomFilter) (MultiIndex, error) {
+	filters := make([]*bloomFilter, len(indexes))
+	for i, index := range indexes {
+		bf, ok := index.(*bloomFilter)
+		if !ok || bf == nil || (bf.bitMask+1)>>3 > uint64(len(bf.buffer)) {
+			return nil, ErrIncompatibleBloomFilter
+		}
+		if i > 0 && (len(bf.buffer) != len(filters[0].buffer) || bf.bitMask != filters[0].bitMask ||
+			bf.hashCount != filters[0].hashCount) {
+			return nil, ErrIncompatibleBloomFilter
+		}
+		filters[i] = bf
+	}
+	if len(filters) == 0 {
+		return &bitSlicedIndex{}, nil
+	}
+
+	idx := &bitSlicedIndex{
+		count:     uint64(len(filters)),
+		bitMask:   filters[0].bitMask,
+		hashCount: filters[0].hashCount,
+	}
+	// an additional word allows to read the bits of the last position without checking the bounds
+	idx.words = make([]uint64, ((idx.bitMask+1)*idx.count+63)/64+1)
+	for i, bf := range filters {
+		for k, b := range bf.buffer[:(idx.bitMask+1)>>3] {
+			for ; b != 0; b &= b - 1 {
+				pos := uint64(k)<<3 | uint64(bits2.TrailingZeros8(b))
+				bit := pos*idx.count + uint64(i)
+				idx.words[bit>>6] |= 1 << (bit & 63)
+			}
+		}
+	}
+
+	return idx, nil
+}
+
+func (idx *bitSlicedIndex) Len() int {
+	return int(idx.count)
+}
+
+func (idx *bitSlicedIndex) searchSha1(sha1 []uint32, matches []uint32) bool {
+	any := false
+
+	// the bits of the BloomFilter are compared in groups of 64, so that a group is compared with a word for each hash
+	for first := uint64(0); first < idx.count; first += 64 {
+		group := ^uint64(0)
+		if idx.count-first < 64 {
+			group = 1<<(idx.count-first) - 1
+		}
+		for i := uint16(0); i < idx.hashCount && group != 0; i++ {
+			pos := uint64(sha1[i]) & idx.bitMask
+			group &= idx.readBits(pos*idx.count + first)
+		}
+		if group != 0 {
+			any = true
+		}
+		for ; group != 0; group &= group - 1 {
+			matches[first+uint64(bits2.TrailingZeros64(group))]++
+		}
+	}
+
+	return any
+}
+
+// readBits returns the 64 bits starting at bit.
+func (idx *bitSlicedIndex) readBits(bit uint64) uint64 {
+	word, shift := bit>>6, bit&63
+	if shift == 0 {
+		return idx.words[word]
+	}
+	return idx.words[word]>>shift | idx.words[word+1]<<(64-shift)
+}
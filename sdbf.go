@@ -2,19 +2,39 @@ package sdhash
 
 import (
 	"bufio"
+	"encoding"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/tmthrgd/go-popcount"
 	"io"
+	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 )
 
 // Sdbf represent the similarity digest of a file and can be compared for similarity to others Sdbf.
+// A Sdbf is immutable once created, except by UnmarshalBinary and ReadFrom, so it is safe for concurrent use by
+// multiple goroutines.
 type Sdbf interface {
 
+	// MarshalBinary returns the compact binary encoding of the Sdbf, which can be decoded with ParseSdbfFromBytes.
+	// The binary encoding is versioned and contains a checksum of the encoded data.
+	encoding.BinaryMarshaler
+
+	// UnmarshalBinary replaces the Sdbf with the one decoded from its binary encoding, like ParseSdbfFromBytes.
+	// It must not be called on a Sdbf used by other goroutines; ParseSdbfFromBytes returns a new Sdbf instead.
+	encoding.BinaryUnmarshaler
+
+	// WriteTo writes the binary encoding of the Sdbf to w, which can be read back with ReadSdbf.
+	io.WriterTo
+
+	// ReadFrom replaces the Sdbf with the one read from r, like ReadSdbf.
+	// It must not be called on a Sdbf used by other goroutines; ReadSdbf returns a new Sdbf instead.
+	io.ReaderFrom
+
 	// Name of the of the file or data this Sdbf represents.
 	Name() string
 
@@ -29,25 +49,68 @@ type Sdbf interface {
 
 	// Compare two Sdbf and provide a similarity score ranges between 0 and 100.
 	// A score of 0 means that the two files are very different, a score of 100 means that the two files are equals.
-	Compare(other Sdbf) int
+	// It returns ErrIncompatibleDigest if other was not created by this package.
+	Compare(other Sdbf) (int, error)
 
 	// CompareSample compare two Sdbf with sampling and provide a similarity score ranges between 0 and 100.
 	// A score of 0 means that the two files are very different, a score of 100 means that the two files are equals.
-	CompareSample(other Sdbf, sample uint32) int
+	// At most sample filters are compared, picked evenly across the digest; a value of 0 disables sampling.
+	// It is equivalent to CompareSampleSeed with DefaultSeed, so its results are reproducible.
+	// It returns ErrIncompatibleDigest if other was not created by this package.
+	CompareSample(other Sdbf, sample uint32) (int, error)
+
+	// CompareSampleSeed is like CompareSample, but the sampled filters are picked using a random generator
+	// initialized with seed. The same seed always produces the same score.
+	CompareSampleSeed(other Sdbf, sample uint32, seed int64) (int, error)
+
+	// CompareThreshold compare two Sdbf like Compare, but stops as soon as the score is known to be lower than
+	// threshold. If the score is greater or equal than threshold, the same score of Compare is returned;
+	// otherwise an upper bound of the score, lower than threshold, is returned.
+	CompareThreshold(other Sdbf, threshold int) (int, error)
+
+	// Matches reports whether the score of the two Sdbf is greater or equal than threshold. The comparison stops
+	// as soon as the answer is known, so it is faster than Compare.
+	Matches(other Sdbf, threshold int) (bool, error)
+
+	// CompareDetailed compare two Sdbf like Compare, and also returns the matching regions of the two inputs.
+	// For each filter of the smaller Sdbf, the best matching filter of the other Sdbf is reported if their score is
+	// greater than 0. The regions are sorted by the filter index of this Sdbf.
+	CompareDetailed(other Sdbf) (int, []Region, error)
+
+	// Containment compare two Sdbf in both directions, and provide the scores of this Sdbf contained in other and
+	// of other contained in this Sdbf, ranging between 0 and 100. Unlike Compare, which always measures the smaller
+	// Sdbf against the larger one, the scores are asymmetric and can be used to find small files embedded in large
+	// ones. It returns ErrIncompatibleDigest if other was not created by this package.
+	Containment(other Sdbf) (int, int, error)
 
 	// String returns the encoded Sdbf as a string.
 	String() string
 
 	// GetIndex returns the BloomFilter index used during the digesting process.
+	// Decoded Sdbf have no index, and nil is returned.
 	GetIndex() BloomFilter
 
-	// GetSearchIndexesResults returns search indexes results.
-	// The return value is an array of size == len(searchIndexes), and each elements has another array of length bfCount.
+	// GetSearchIndexesResults returns search indexes results, both in stream mode and in block mode.
+	// The return value is an array of length bfCount, and each element has another array of size == searchIndexes.Len()
+	// with the number of sampled features of the bloom filter found in each search index.
 	GetSearchIndexesResults() [][]uint32
 
-	// Fast modify the bloom filter buffer for faster comparison.
-	// Warning: the operation overwrite the original buffer.
-	Fast()
+	// Folded returns a copy of the Sdbf whose bloom filters are folded for faster comparisons, which are less accurate.
+	// Folded Sdbf can be compared only with other folded Sdbf, otherwise ErrIncompatibleDigest is returned.
+	// The original Sdbf is not modified.
+	Folded() Sdbf
+}
+
+// Region is a pair of matching filters of two compared Sdbf, A and B, with the ranges of the inputs they digest.
+// The ranges are known only for Sdbf generated in block mode, otherwise offsets and lengths are -1.
+type Region struct {
+	FilterA uint32 // index of the filter of A
+	FilterB uint32 // index of the filter of B
+	OffsetA int64  // offset in bytes of the region of A
+	LengthA int64  // length in bytes of the region of A
+	OffsetB int64  // offset in bytes of the region of B
+	LengthB int64  // length in bytes of the region of B
+	Score   int    // similarity score of the two regions, between 0 and 100
 }
 
 type sdbf struct {
@@ -64,9 +127,11 @@ type sdbf struct {
 	origFileSize         uint64        // size of the original file
 	fastMode             bool          // use fast mode during comparison
 	index                BloomFilter   // bloom filter updated during digest process that can be exported
-	searchIndexes        []BloomFilter // used to search similar bloom filter during digest process; can be nil
+	searchIndexes        MultiIndex    // used to search similar bloom filter during digest process; can be nil
 	searchIndexesResults [][]uint32    // results of search indexes; is nil if searchIndexes is nil
+	searchCount          uint32        // features of the last filter searched in the search indexes (stream mode)
 	indexMutex           sync.Mutex    // mutex used while updating index bloom filter
+	params               Params        // parameters used to generate the sdbf
 }
 
 // ParseSdbfFromString decode a Sdbf from a digest string.
@@ -76,7 +141,7 @@ func ParseSdbfFromString(digest string) (Sdbf, error) {
 
 	sd := &sdbf{
 		bigFilters: make([]BloomFilter, 0),
-		index:      NewBloomFilter(),
+		params:     DefaultParams(),
 	}
 
 	var magic, versionStr, originFileSizeStr, bfSizeStr, maxElemStr, bfCountStr string
@@ -89,8 +154,18 @@ func ParseSdbfFromString(digest string) (Sdbf, error) {
 	}
 	if version, err := strconv.ParseUint(versionStr[:len(versionStr)-1], 10, 64); err != nil {
 		return nil, errors.New("failed to parse version")
-	} else if version > sdbfVersion {
+	} else if version > sdbfFoldedVersion {
 		return nil, errors.New("invalid sdbf version")
+	} else if version >= sdbfParamsVersion {
+		sd.fastMode = version == sdbfFoldedVersion
+		var paramsStr string
+		if paramsStr, err = r.ReadString(':'); err != nil {
+			return nil, errors.New("failed to read params")
+		}
+		if _, err = fmt.Sscanf(paramsStr, "%d,%d,%d,%d:", &sd.params.PopWinSize, &sd.params.Threshold,
+			&sd.params.BlockSize, &sd.params.EntropyWinSize); err != nil {
+			return nil, errors.New("failed to parse params")
+		}
 	}
 	if _, err = r.ReadBytes(':'); err != nil {
 		return nil, errors.New("failed to read hash length")
@@ -110,7 +185,7 @@ func ParseSdbfFromString(digest string) (Sdbf, error) {
 	if bfSizeStr, err = r.ReadString(':'); err != nil {
 		return nil, errors.New("failed to read bloom filter size")
 	}
-	if bfSize, err = strconv.ParseUint(bfSizeStr[:len(bfSizeStr)-1], 10, 64); err != nil {
+	if bfSize, err = strconv.ParseUint(bfSizeStr[:len(bfSizeStr)-1], 10, 32); err != nil {
 		return nil, errors.New("failed to parse bloom filter size")
 	}
 	if _, err = r.ReadBytes(':'); err != nil {
@@ -122,7 +197,7 @@ func ParseSdbfFromString(digest string) (Sdbf, error) {
 	if maxElemStr, err = r.ReadString(':'); err != nil {
 		return nil, errors.New("failed to read max elements count")
 	}
-	if maxElem, err = strconv.ParseUint(maxElemStr[:len(maxElemStr)-1], 10, 64); err != nil {
+	if maxElem, err = strconv.ParseUint(maxElemStr[:len(maxElemStr)-1], 10, 32); err != nil {
 		return nil, errors.New("failed to parse max elements count")
 	}
 	if bfCountStr, err = r.ReadString(':'); err != nil {
@@ -131,6 +206,20 @@ func ParseSdbfFromString(digest string) (Sdbf, error) {
 	if bfCount, err = strconv.ParseUint(bfCountStr[:len(bfCountStr)-1], 10, 64); err != nil {
 		return nil, errors.New("failed to parse bloom filter count")
 	}
+	sd.params.BfSize = uint32(bfSize)
+	if magic[:len(magic)-1] == magicDD {
+		sd.params.MaxElemDd = uint32(maxElem)
+	} else {
+		sd.params.MaxElem = uint32(maxElem)
+	}
+	if err := sd.params.validate(); err != nil {
+		return nil, err
+	}
+	// the filters are encoded in base64 in the digest, so they can't be longer than the digest
+	if bfCount == 0 || bfCount > uint64(len(digest)) || bfSize > uint64(len(digest)) ||
+		bfCount*bfSize > uint64(len(digest)) {
+		return nil, errors.New("invalid bloom filter count")
+	}
 
 	if magic[:len(magic)-1] == magicStream {
 		var lastCountStr, encodedBuffer string
@@ -141,14 +230,18 @@ func ParseSdbfFromString(digest string) (Sdbf, error) {
 		if lastCount, err = strconv.ParseUint(lastCountStr[:len(lastCountStr)-1], 10, 64); err != nil {
 			return nil, errors.New("failed to parse last count")
 		}
+		if lastCount > maxElem {
+			return nil, errors.New("invalid last count")
+		}
 		if encodedBuffer, err = r.ReadString('\n'); err != nil && err != io.EOF {
 			return nil, errors.New("failed to read encoded buffer")
-		} else if err == nil {
-			encodedBuffer = encodedBuffer[:len(encodedBuffer)-1] // remove newline char
 		}
-		if sd.buffer, err = base64.StdEncoding.DecodeString(encodedBuffer); err != nil {
+		if sd.buffer, err = base64.StdEncoding.DecodeString(strings.TrimRight(encodedBuffer, "\r\n")); err != nil {
 			return nil, errors.New("failed to decode base64 buffer")
 		}
+		if uint64(len(sd.buffer)) != bfCount*bfSize {
+			return nil, errors.New("invalid bloom filters buffer length")
+		}
 		sd.lastCount = uint32(lastCount)
 	} else if magic[:len(magic)-1] == magicDD {
 		var ddBlockSizeStr string
@@ -169,16 +262,23 @@ func ParseSdbfFromString(digest string) (Sdbf, error) {
 				return nil, errors.New("failed to read dd elem")
 			}
 			if elem, err = strconv.ParseUint(elemStr[:len(elemStr)-1], 16, 64); err != nil {
-				return nil, errors.New("failed to parse dd block size")
+				return nil, errors.New("failed to parse dd elem")
+			}
+			if elem > maxElem {
+				return nil, errors.New("invalid dd elem")
 			}
 			sd.elemCounts[i] = uint16(elem)
 
 			if encodedBuffer, err = r.ReadString(':'); err != nil && err != io.EOF {
 				return nil, errors.New("failed to read encoded dd buffer")
 			}
-			if tmpBuffer, err = base64.StdEncoding.DecodeString(encodedBuffer[:len(encodedBuffer)-1]); err != nil {
+			// the last buffer is terminated by a newline or by the end of the digest, instead of by a colon
+			if tmpBuffer, err = base64.StdEncoding.DecodeString(strings.TrimRight(encodedBuffer, ":\r\n")); err != nil {
 				return nil, errors.New("failed to decode dd base64 buffer")
 			}
+			if uint64(len(tmpBuffer)) != bfSize {
+				return nil, errors.New("invalid dd buffer length")
+			}
 			copy(sd.buffer[i*bfSize:], tmpBuffer)
 		}
 		sd.ddBlockSize = uint32(ddBlockSize)
@@ -196,13 +296,16 @@ func ParseSdbfFromString(digest string) (Sdbf, error) {
 	return sd, nil
 }
 
-// createSdbf create and digest a sdbf file from an initial buffer.
-func createSdbf(buffer []uint8, ddBlockSize uint32, initialIndex BloomFilter, searchIndexes []BloomFilter,
-	name string) *sdbf {
+// newSdbf create an empty sdbf, ready to digest data in stream mode if ddBlockSize is 0 or in block mode otherwise.
+func newSdbf(params Params, ddBlockSize uint32, initialIndex BloomFilter, searchIndexes MultiIndex,
+	name string) (*sdbf, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
 	sd := &sdbf{
 		hashName:      name,
-		bfSize:        BfSize,
-		bfCount:       1,
+		params:        params,
+		bfSize:        params.BfSize,
 		bigFilters:    make([]BloomFilter, 0),
 		index:         initialIndex,
 		searchIndexes: searchIndexes,
@@ -211,30 +314,23 @@ func createSdbf(buffer []uint8, ddBlockSize uint32, initialIndex BloomFilter, se
 		sd.index = NewBloomFilter()
 	}
 	if bf, err := newBloomFilter(bigFilter, 5, bigFilterElem); err != nil {
-		panic(err)
+		return nil, err
 	} else {
 		sd.bigFilters = append(sd.bigFilters, bf)
 	}
-	fileSize := uint64(len(buffer))
-	sd.origFileSize = fileSize
 	if ddBlockSize == 0 { // stream mode
-		sd.maxElem = MaxElem
-		sd.generateChunkSdbf(buffer, 32*mB)
-	} else { // block mode
-		sd.maxElem = MaxElemDd
-		ddBlockCnt := fileSize / uint64(ddBlockSize)
-		if fileSize%uint64(ddBlockSize) >= MinFileSize {
-			ddBlockCnt++
+		sd.maxElem = params.MaxElem
+		sd.bfCount = 1
+		sd.buffer = make([]uint8, sd.bfSize)
+		if searchIndexes != nil {
+			sd.searchIndexesResults = [][]uint32{make([]uint32, searchIndexes.Len())}
 		}
-		sd.bfCount = uint32(ddBlockCnt)
+	} else { // block mode
+		sd.maxElem = params.MaxElemDd
 		sd.ddBlockSize = ddBlockSize
-		sd.buffer = make([]uint8, ddBlockCnt*uint64(BfSize))
-		sd.elemCounts = make([]uint16, ddBlockCnt)
-		sd.generateBlockSdbf(buffer)
 	}
-	sd.computeHamming()
 
-	return sd
+	return sd, nil
 }
 
 func (sd *sdbf) Name() string {
@@ -249,18 +345,105 @@ func (sd *sdbf) InputSize() uint64 {
 	return sd.origFileSize
 }
 
-func (sd *sdbf) Compare(other Sdbf) int {
+func (sd *sdbf) Compare(other Sdbf) (int, error) {
 	return sd.CompareSample(other, 0)
 }
 
-func (sd *sdbf) CompareSample(other Sdbf, sample uint32) int {
-	return sd.sdbfScore(sd, other.(*sdbf), sample)
+func (sd *sdbf) CompareSample(other Sdbf, sample uint32) (int, error) {
+	return sd.CompareSampleSeed(other, sample, DefaultSeed)
+}
+
+func (sd *sdbf) CompareSampleSeed(other Sdbf, sample uint32, seed int64) (int, error) {
+	otherSd, err := sd.compatibleSdbf(other)
+	if err != nil {
+		return 0, err
+	}
+	return sd.sdbfScore(sd, otherSd, sample, seed, nil), nil
+}
+
+func (sd *sdbf) CompareThreshold(other Sdbf, threshold int) (int, error) {
+	otherSd, err := sd.compatibleSdbf(other)
+	if err != nil {
+		return 0, err
+	}
+	return sd.sdbfThresholdScore(sd, otherSd, 0, DefaultSeed, threshold, false), nil
+}
+
+func (sd *sdbf) Matches(other Sdbf, threshold int) (bool, error) {
+	otherSd, err := sd.compatibleSdbf(other)
+	if err != nil {
+		return false, err
+	}
+	return sd.sdbfThresholdScore(sd, otherSd, 0, DefaultSeed, threshold, true) >= threshold, nil
+}
+
+func (sd *sdbf) CompareDetailed(other Sdbf) (int, []Region, error) {
+	otherSd, err := sd.compatibleSdbf(other)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	regions := make([]Region, 0)
+	score := sd.sdbfScore(sd, otherSd, 0, DefaultSeed, func(index1, index2 uint32, score float64) {
+		region := Region{
+			FilterA: index1,
+			FilterB: index2,
+			Score:   int(math.Round(100.0 * score)),
+		}
+		region.OffsetA, region.LengthA = sd.filterRange(index1)
+		region.OffsetB, region.LengthB = otherSd.filterRange(index2)
+		regions = append(regions, region)
+	})
+	sort.SliceStable(regions, func(i, j int) bool {
+		return regions[i].FilterA < regions[j].FilterA
+	})
+
+	return score, regions, nil
+}
+
+func (sd *sdbf) Containment(other Sdbf) (int, int, error) {
+	otherSd, err := sd.compatibleSdbf(other)
+	if err != nil {
+		return 0, 0, err
+	}
+	return sd.sdbfDirectedScore(sd, otherSd, sd.bfCount, DefaultSeed, sd.sdbfMaxScore, nil),
+		sd.sdbfDirectedScore(otherSd, sd, otherSd.bfCount, DefaultSeed, sd.sdbfMaxScore, nil), nil
+}
+
+// compatibleSdbf returns other as *sdbf if it can be compared with sd, or ErrIncompatibleDigest otherwise.
+func (sd *sdbf) compatibleSdbf(other Sdbf) (*sdbf, error) {
+	otherSd, ok := other.(*sdbf)
+	if !ok || otherSd == nil {
+		return nil, ErrIncompatibleDigest
+	}
+	if !sd.params.compatible(otherSd.params) {
+		return nil, fmt.Errorf("%w: digests generated with different params", ErrIncompatibleDigest)
+	}
+	if sd.fastMode != otherSd.fastMode {
+		return nil, fmt.Errorf("%w: folded and unfolded digests", ErrIncompatibleDigest)
+	}
+	return otherSd, nil
+}
+
+// filterRange returns the offset and the length of the input digested in the filter at index.
+// The range is known only in block mode, otherwise -1 is returned for both values.
+func (sd *sdbf) filterRange(index uint32) (int64, int64) {
+	if sd.elemCounts == nil || sd.ddBlockSize == 0 {
+		return -1, -1
+	}
+	offset := int64(index) * int64(sd.ddBlockSize)
+	length := int64(sd.ddBlockSize)
+	if offset+length > int64(sd.origFileSize) {
+		length = int64(sd.origFileSize) - offset
+	}
+	return offset, length
 }
 
 func (sd *sdbf) String() string {
 	var sb strings.Builder
 	if sd.elemCounts == nil {
-		sb.WriteString(fmt.Sprintf("%s:%02d:", magicStream, sdbfVersion))
+		sb.WriteString(magicStream)
+		sd.writeVersion(&sb)
 		sb.WriteString(fmt.Sprintf("%d:%s:%d:sha1:", len(sd.hashName), sd.hashName, sd.origFileSize))
 		sb.WriteString(fmt.Sprintf("%d:%d:%x:", sd.bfSize, defaultHashCount, defaultMask))
 		sb.WriteString(fmt.Sprintf("%d:%d:%d:", sd.maxElem, sd.bfCount, sd.lastCount))
@@ -275,7 +458,8 @@ func (sd *sdbf) String() string {
 			sb.WriteString(base64.StdEncoding.EncodeToString(sd.buffer[pos : pos+uint64(rem*sd.bfSize)]))
 		}
 	} else {
-		sb.WriteString(fmt.Sprintf("%s:%02d:", magicDD, sdbfVersion))
+		sb.WriteString(magicDD)
+		sd.writeVersion(&sb)
 		sb.WriteString(fmt.Sprintf("%d:%s:%d:sha1:", len(sd.hashName), sd.hashName, sd.origFileSize))
 		sb.WriteString(fmt.Sprintf("%d:%d:%x:", sd.bfSize, defaultHashCount, defaultMask))
 		sb.WriteString(fmt.Sprintf("%d:%d:%d", sd.maxElem, sd.bfCount, sd.ddBlockSize))
@@ -289,6 +473,21 @@ func (sd *sdbf) String() string {
 	return sb.String()
 }
 
+// writeVersion writes the version of the encoded Sdbf, followed by the parameters used to generate the Sdbf
+// if they are not the default ones or if the Sdbf is folded.
+func (sd *sdbf) writeVersion(sb *strings.Builder) {
+	if sd.params.isDefault() && !sd.fastMode {
+		sb.WriteString(fmt.Sprintf(":%02d:", sdbfVersion))
+		return
+	}
+	version := sdbfParamsVersion
+	if sd.fastMode {
+		version = sdbfFoldedVersion
+	}
+	sb.WriteString(fmt.Sprintf(":%02d:%d,%d,%d,%d:", version, sd.params.PopWinSize, sd.params.Threshold,
+		sd.params.BlockSize, sd.params.EntropyWinSize))
+}
+
 func (sd *sdbf) GetIndex() BloomFilter {
 	return sd.index
 }
@@ -301,16 +500,37 @@ func (sd *sdbf) FilterCount() uint32 {
 	return sd.bfCount
 }
 
-func (sd *sdbf) Fast() {
+func (sd *sdbf) Folded() Sdbf {
+	if sd.fastMode {
+		return sd
+	}
+	folded := &sdbf{
+		hamming:              make([]uint16, sd.bfCount),
+		buffer:               make([]uint8, len(sd.buffer)),
+		maxElem:              sd.maxElem,
+		bigFilters:           sd.bigFilters,
+		hashName:             sd.hashName,
+		bfCount:              sd.bfCount,
+		bfSize:               sd.bfSize,
+		lastCount:            sd.lastCount,
+		elemCounts:           sd.elemCounts,
+		ddBlockSize:          sd.ddBlockSize,
+		origFileSize:         sd.origFileSize,
+		fastMode:             true,
+		index:                sd.index,
+		searchIndexes:        sd.searchIndexes,
+		searchIndexesResults: sd.searchIndexesResults,
+		params:               sd.params,
+	}
 	for i := uint32(0); i < sd.bfCount; i++ {
 		data := sd.cloneFilter(i)
 		tmp := newBloomFilterFromExistingData(data, int(sd.getElemCount(uint64(i))))
 		tmp.fold(2)
 		tmp.computeHamming()
-		sd.hamming[i] = uint16(tmp.hamming)
-		copy(sd.buffer[i*sd.bfSize:(i+1)*sd.bfSize], tmp.buffer)
+		folded.hamming[i] = uint16(tmp.hamming)
+		copy(folded.buffer[i*sd.bfSize:(i+1)*sd.bfSize], tmp.buffer)
 	}
-	sd.fastMode = true
+	return folded
 }
 
 // getElemCount returns element count for comparisons
@@ -0,0 +1,250 @@
+package sdhash
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// The binary encoding of a Sdbf is composed by a header, a payload and a checksum:
+//
+//	magic (4 bytes) | version (1 byte) | payload length (uint64) | payload | crc32 of all the previous bytes (uint32)
+//
+// The payload contains, in order: the flags (1 byte, binaryFlagBlockMode is set in block mode and binaryFlagFolded
+// is set if the filters are folded), the seven Params
+// (uint32 each), the name length (uint32), the name, the original file size (uint64), the filters count (uint32),
+// the last filter elements count in stream mode or the block size in block mode (uint32), the elements count of
+// each filter in block mode (uint16 each) and finally the filters buffer. All integers are little endian.
+const (
+	binaryMagic         = "SDBF"
+	binaryVersion       = 1
+	binaryHeaderSize    = len(binaryMagic) + 1 + 8
+	binaryChecksumSize  = 4
+	binaryFlagBlockMode = 0x01
+	binaryFlagFolded    = 0x02
+)
+
+func (sd *sdbf) MarshalBinary() ([]uint8, error) {
+	var flags uint8
+	var modeValue uint32
+	var elemCountsSize int
+	if sd.elemCounts != nil {
+		flags |= binaryFlagBlockMode
+		modeValue = sd.ddBlockSize
+		elemCountsSize = 2 * int(sd.bfCount)
+	} else {
+		modeValue = sd.lastCount
+	}
+	if sd.fastMode {
+		flags |= binaryFlagFolded
+	}
+	filtersSize := int(sd.bfCount) * int(sd.bfSize)
+	payloadSize := 1 + 7*4 + 4 + len(sd.hashName) + 8 + 4 + 4 + elemCountsSize + filtersSize
+
+	buf := bytes.NewBuffer(make([]uint8, 0, binaryHeaderSize+payloadSize+binaryChecksumSize))
+	buf.WriteString(binaryMagic)
+	buf.WriteByte(binaryVersion)
+	_ = binary.Write(buf, binary.LittleEndian, uint64(payloadSize))
+	buf.WriteByte(flags)
+	_ = binary.Write(buf, binary.LittleEndian, []uint32{sd.params.BfSize, sd.params.PopWinSize, sd.params.MaxElem,
+		sd.params.MaxElemDd, sd.params.Threshold, sd.params.BlockSize, sd.params.EntropyWinSize})
+	_ = binary.Write(buf, binary.LittleEndian, uint32(len(sd.hashName)))
+	buf.WriteString(sd.hashName)
+	_ = binary.Write(buf, binary.LittleEndian, sd.origFileSize)
+	_ = binary.Write(buf, binary.LittleEndian, []uint32{sd.bfCount, modeValue})
+	if sd.elemCounts != nil {
+		_ = binary.Write(buf, binary.LittleEndian, sd.elemCounts[:sd.bfCount])
+	}
+	buf.Write(sd.buffer[:filtersSize])
+	_ = binary.Write(buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	return buf.Bytes(), nil
+}
+
+// ParseSdbfFromBytes decode a Sdbf from its binary encoding, produced by MarshalBinary.
+func ParseSdbfFromBytes(data []uint8) (Sdbf, error) {
+	if len(data) < binaryHeaderSize+binaryChecksumSize {
+		return nil, errors.New("failed to read binary header")
+	}
+	if string(data[:len(binaryMagic)]) != binaryMagic {
+		return nil, errors.New("invalid binary magic")
+	}
+	if data[len(binaryMagic)] != binaryVersion {
+		return nil, errors.New("invalid binary version")
+	}
+	payloadSize := binary.LittleEndian.Uint64(data[len(binaryMagic)+1 : binaryHeaderSize])
+	if payloadSize != uint64(len(data)-binaryHeaderSize-binaryChecksumSize) {
+		return nil, errors.New("invalid binary payload length")
+	}
+	checksumPos := len(data) - binaryChecksumSize
+	if crc32.ChecksumIEEE(data[:checksumPos]) != binary.LittleEndian.Uint32(data[checksumPos:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	r := bytes.NewReader(data[binaryHeaderSize:checksumPos])
+	var flags uint8
+	var rawParams [7]uint32
+	var nameLen uint32
+	if err := binary.Read(r, binary.LittleEndian, &flags); err != nil {
+		return nil, errors.New("failed to read flags")
+	}
+	if err := binary.Read(r, binary.LittleEndian, &rawParams); err != nil {
+		return nil, errors.New("failed to read params")
+	}
+	if err := binary.Read(r, binary.LittleEndian, &nameLen); err != nil || uint64(nameLen) > uint64(r.Len()) {
+		return nil, errors.New("failed to read name length")
+	}
+	name := make([]uint8, nameLen)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, errors.New("failed to read name")
+	}
+	var origFileSize uint64
+	if err := binary.Read(r, binary.LittleEndian, &origFileSize); err != nil {
+		return nil, errors.New("failed to read origin file size")
+	}
+	var counts [2]uint32
+	if err := binary.Read(r, binary.LittleEndian, &counts); err != nil {
+		return nil, errors.New("failed to read bloom filter count")
+	}
+
+	if counts[0] == 0 {
+		return nil, errors.New("invalid bloom filter count")
+	}
+	params := Params{
+		BfSize:         rawParams[0],
+		PopWinSize:     rawParams[1],
+		MaxElem:        rawParams[2],
+		MaxElemDd:      rawParams[3],
+		Threshold:      rawParams[4],
+		BlockSize:      rawParams[5],
+		EntropyWinSize: rawParams[6],
+	}
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+
+	sd := &sdbf{
+		hashName:     string(name),
+		origFileSize: origFileSize,
+		bfSize:       params.BfSize,
+		bfCount:      counts[0],
+		fastMode:     flags&binaryFlagFolded != 0,
+		bigFilters:   make([]BloomFilter, 0),
+		params:       params,
+	}
+	if flags&binaryFlagBlockMode != 0 {
+		sd.ddBlockSize = counts[1]
+		sd.maxElem = sd.params.MaxElemDd
+		if uint64(sd.bfCount)*2 > uint64(r.Len()) {
+			return nil, errors.New("failed to read dd elements count")
+		}
+		sd.elemCounts = make([]uint16, sd.bfCount)
+		if err := binary.Read(r, binary.LittleEndian, sd.elemCounts); err != nil {
+			return nil, errors.New("failed to read dd elements count")
+		}
+		for _, elemCount := range sd.elemCounts {
+			if uint32(elemCount) > sd.maxElem {
+				return nil, errors.New("invalid dd elements count")
+			}
+		}
+	} else {
+		sd.lastCount = counts[1]
+		sd.maxElem = sd.params.MaxElem
+		if sd.lastCount > sd.maxElem {
+			return nil, errors.New("invalid last elements count")
+		}
+	}
+	if uint64(sd.bfCount)*uint64(sd.bfSize) != uint64(r.Len()) {
+		return nil, errors.New("invalid bloom filters buffer length")
+	}
+	sd.buffer = make([]uint8, r.Len())
+	_, _ = r.Read(sd.buffer)
+	sd.computeHamming()
+
+	return sd, nil
+}
+
+func (sd *sdbf) UnmarshalBinary(data []uint8) error {
+	decoded, err := ParseSdbfFromBytes(data)
+	if err != nil {
+		return err
+	}
+	sd.replace(decoded.(*sdbf))
+	return nil
+}
+
+func (sd *sdbf) WriteTo(w io.Writer) (int64, error) {
+	data, err := sd.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(data)
+	return int64(n), err
+}
+
+// ReadSdbf reads and decode the binary encoding of a Sdbf, produced by WriteTo.
+// Only the bytes of a single Sdbf are read from r, so multiple Sdbf can be read from the same reader.
+func ReadSdbf(r io.Reader) (Sdbf, error) {
+	header := make([]uint8, binaryHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, errors.New("failed to read binary header")
+	}
+	if string(header[:len(binaryMagic)]) != binaryMagic {
+		return nil, errors.New("invalid binary magic")
+	}
+
+	payloadSize := binary.LittleEndian.Uint64(header[len(binaryMagic)+1:])
+	data := bytes.NewBuffer(header)
+	if _, err := io.CopyN(data, r, int64(payloadSize)+binaryChecksumSize); err != nil {
+		return nil, errors.New("failed to read binary payload")
+	}
+
+	return ParseSdbfFromBytes(data.Bytes())
+}
+
+func (sd *sdbf) ReadFrom(r io.Reader) (int64, error) {
+	counter := &countingReader{r: r}
+	decoded, err := ReadSdbf(counter)
+	if err != nil {
+		return counter.n, err
+	}
+	sd.replace(decoded.(*sdbf))
+	return counter.n, nil
+}
+
+// replace overwrites the fields of sd with the ones of other, which is a new decoded sdbf.
+func (sd *sdbf) replace(other *sdbf) {
+	sd.hashName = other.hashName
+	sd.origFileSize = other.origFileSize
+	sd.params = other.params
+	sd.bfSize = other.bfSize
+	sd.bfCount = other.bfCount
+	sd.maxElem = other.maxElem
+	sd.lastCount = other.lastCount
+	sd.elemCounts = other.elemCounts
+	sd.ddBlockSize = other.ddBlockSize
+	sd.fastMode = other.fastMode
+	sd.buffer = other.buffer
+	sd.hamming = other.hamming
+	sd.bigFilters = other.bigFilters
+	sd.index = nil
+	sd.searchIndexes = nil
+	sd.searchIndexesResults = nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []uint8) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
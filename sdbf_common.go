@@ -1,33 +1,45 @@
 package sdhash
 
-import "math"
+import (
+	"errors"
+	"math"
+)
 
 var (
-	BfSize         uint32 = 256    // BfSize is the size of each bloom filters
-	PopWinSize     uint32 = 64     // PopWinSize is the size of the sliding window used to hash input.
-	MaxElem        uint32 = 160    // MaxElem is maximum number of elements in each bloom filter in stream mode.
-	MaxElemDd      uint32 = 192    // MaxElem is maximum number of elements in each bloom filter in block mode.
-	Threshold      uint32 = 16     // Threshold is the minimum value of the score above witch chunks are considered.
-	BlockSize             = 4 * kB // BlockSize is the block size used to generate chunk ranks.
-	EntropyWinSize        = 64     // EntropyWinSize is the entropy window size used to generate chunk ranks.
+	// ErrInputTooSmall is returned when the data to digest is shorter than MinFileSize.
+	ErrInputTooSmall = errors.New("input is too small")
+	// ErrIncompatibleDigest is returned when a Sdbf cannot be compared with another Sdbf.
+	ErrIncompatibleDigest = errors.New("incompatible digest")
+	// ErrInvalidParams is returned when the Params cannot be used to generate a Sdbf.
+	ErrInvalidParams = errors.New("invalid params")
+	// ErrIncompatibleBloomFilter is returned when a BloomFilter cannot be merged with another BloomFilter.
+	ErrIncompatibleBloomFilter = errors.New("incompatible bloom filter")
+	// ErrSourceConsumed is returned when a SdbfFactory created from a io.Reader computes a digest a second time.
+	ErrSourceConsumed = errors.New("source already consumed")
 )
 
 const (
 	MinFileSize = 512 // Minimum file size for a Sdbf file.
-
-	kB           = 1024
-	mB           = kB * kB
-	bins         = 1000
-	entropyPower = 10
-	entropyScale = bins * (1 << entropyPower)
-	minElemCount = 16
+	DefaultSeed = 0   // Seed used by CompareSample to pick the sampled filters.
+
+	kB              = 1024
+	mB              = kB * kB
+	streamChunkSize = 32 * mB // size of the chunks in stream mode
+	blockWindowSize = 32 * mB // size of the input window kept in memory in block mode
+	bins            = 1000
+	entropyPower    = 10
+	entropyScale    = bins * (1 << entropyPower)
+	minElemCount    = 16
+	scoreBoundSlack = 1e-9 // margin for the rounding errors of the score bounds used to stop comparisons early
 
 	bigFilter     = 16384
 	bigFilterElem = 8738
 
-	magicStream = "sdbf"
-	sdbfVersion = 3
-	magicDD     = "sdbf-dd"
+	magicStream       = "sdbf"
+	sdbfVersion       = 3 // version of the original sdhash format, used with the default parameters
+	sdbfParamsVersion = 4 // version of the format which contains the parameters in the header
+	sdbfFoldedVersion = 5 // version of the format of folded Sdbf, which contains the parameters in the header
+	magicDD           = "sdbf-dd"
 
 	defaultMask      = 0x7FF
 	defaultHashCount = 5
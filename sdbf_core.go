@@ -1,30 +1,47 @@
 package sdhash
 
 import (
+	"context"
 	"math"
 	"math/rand"
+	"runtime"
 	"strings"
+	"sync"
 )
 
+// rankState holds the rolling entropy state used to generate the ranks of a chunk incrementally.
+type rankState struct {
+	entropy uint64  // entropy of the last ranked window
+	ascii   []uint8 // characters count of the last ranked window
+	offset  int     // next offset of the chunk to be ranked
+}
+
 // generateChunkRanks generate ranks for a file chunk.
 func (sd *sdbf) generateChunkRanks(fileBuffer []uint8, chunkRanks []uint16) {
-	var entropy uint64
-	ascii := make([]uint8, 256)
+	sd.updateChunkRanks(&rankState{}, fileBuffer, chunkRanks)
+}
 
-	limit := len(fileBuffer) - EntropyWinSize
-	for offset := 0; limit > 0 && offset < limit; offset++ {
-		if offset%BlockSize == 0 { // Initial/sync entropy calculation
-			entropy = entropy64InitInt(fileBuffer[offset:], ascii)
+// updateChunkRanks generate ranks for the offsets of a partial file chunk which are not ranked yet.
+// The rolling entropy is kept in rs, so the chunk can be ranked while it grows.
+func (sd *sdbf) updateChunkRanks(rs *rankState, fileBuffer []uint8, chunkRanks []uint16) {
+	if rs.ascii == nil {
+		rs.ascii = make([]uint8, 256)
+	}
+
+	limit := len(fileBuffer) - int(sd.params.EntropyWinSize)
+	for ; limit > 0 && rs.offset < limit; rs.offset++ {
+		if rs.offset%int(sd.params.BlockSize) == 0 { // Initial/sync entropy calculation
+			rs.entropy = entropy64InitInt(fileBuffer[rs.offset:], rs.ascii)
 		} else { // Incremental entropy update (much faster)
-			entropy = entropy64IncInt(entropy, fileBuffer[offset-1:], ascii)
+			rs.entropy = entropy64IncInt(rs.entropy, fileBuffer[rs.offset-1:], rs.ascii)
 		}
-		chunkRanks[offset] = uint16(entropy64Ranks[entropy>>entropyPower])
+		chunkRanks[rs.offset] = uint16(entropy64Ranks[rs.entropy>>entropyPower])
 	}
 }
 
 // generateChunkScores generate scores for a ranks chunk.
 func (sd *sdbf) generateChunkScores(chunkRanks []uint16, chunkSize uint64, chunkScores []uint16, scoreHistogram []int32) {
-	popWin := uint64(PopWinSize)
+	popWin := uint64(sd.params.PopWinSize)
 	var minPos uint64
 	minRank := chunkRanks[minPos]
 
@@ -60,21 +77,30 @@ func (sd *sdbf) generateChunkScores(chunkRanks []uint16, chunkSize uint64, chunk
 }
 
 // generateChunkHash generate SHA1 hashes and add them to the Sdbf in stream mode.
-func (sd *sdbf) generateChunkHash(fileBuffer []uint8, chunkPos uint64, chunkScores []uint16, chunkSize uint64) {
+func (sd *sdbf) generateChunkHash(chunkBuffer []uint8, chunkScores []uint16, chunkSize uint64) error {
 	bfCount := sd.bfCount
 	lastCount := sd.lastCount
 	currBf := sd.buffer[(bfCount-1)*sd.bfSize:]
 	var bigFiltersCount uint64
 
-	if chunkSize > uint64(PopWinSize) {
-		for i := uint64(0); i < chunkSize-uint64(PopWinSize); i++ {
-			if uint32(chunkScores[i]) > Threshold {
-				sha1Hash := u32sha1(fileBuffer[chunkPos+i : chunkPos+i+uint64(PopWinSize)])
+	popWin := uint64(sd.params.PopWinSize)
+	if chunkSize > popWin {
+		for i := uint64(0); i < chunkSize-popWin; i++ {
+			if uint32(chunkScores[i]) > sd.params.Threshold {
+				sha1Hash := u32sha1(chunkBuffer[i : i+popWin])
 				bitsSet := bfSha1Insert(currBf, sha1Hash)
 				// Avoid potentially repetitive features
 				if bitsSet == 0 {
 					continue
 				}
+				// the search indexes are checked before the features already in the index are skipped, like in
+				// block mode, so that both modes search the same features
+				if sd.searchIndexes != nil {
+					if sd.searchCount%4 == 0 { // sampled like in block mode
+						sd.checkIndexes(sha1Hash[:], sd.searchIndexesResults[bfCount-1])
+					}
+					sd.searchCount++
+				}
 				if sd.index != nil {
 					if !sd.index.insertSha1(sha1Hash[:]) {
 						continue
@@ -93,11 +119,15 @@ func (sd *sdbf) generateChunkHash(fileBuffer []uint8, chunkPos uint64, chunkScor
 					currBf = currBf[sd.bfSize:]
 					bfCount++
 					lastCount = 0
+					if sd.searchIndexes != nil {
+						sd.searchCount = 0
+						sd.searchIndexesResults = append(sd.searchIndexesResults, make([]uint32, sd.searchIndexes.Len()))
+					}
 				}
 				if bigFiltersCount == sd.bigFilters[len(sd.bigFilters)-1].MaxElem() {
 					bf, err := newBloomFilter(bigFilter, 5, bigFilterElem)
 					if err != nil {
-						panic(err)
+						return err
 					}
 					sd.bigFilters = append(sd.bigFilters, bf)
 					bigFiltersCount = 0
@@ -108,6 +138,8 @@ func (sd *sdbf) generateChunkHash(fileBuffer []uint8, chunkPos uint64, chunkScor
 
 	sd.bfCount = bfCount
 	sd.lastCount = lastCount
+
+	return nil
 }
 
 // generateBlockHash generate SHA1 hashes and add them to the Sdbf in block-aligned mode.
@@ -121,12 +153,13 @@ func (sd *sdbf) generateBlockHash(fileBuffer []uint8, blockNum uint64, chunkScor
 		maxOffset = sd.ddBlockSize
 	}
 	if sd.searchIndexes != nil {
-		numIndexMatches = uint32(len(sd.searchIndexes))
+		numIndexMatches = uint32(sd.searchIndexes.Len())
 	}
 	match := make([]uint32, numIndexMatches)
-	for i := uint32(0); i < maxOffset-PopWinSize && hashCnt < MaxElemDd; i++ {
+	popWin := sd.params.PopWinSize
+	for i := uint32(0); i < maxOffset-popWin && hashCnt < sd.maxElem; i++ {
 		if uint32(chunkScores[i]) > threshold || (uint32(chunkScores[i]) == threshold && allowed > 0) {
-			sha1Hash := u32sha1(fileBuffer[i : i+PopWinSize])
+			sha1Hash := u32sha1(fileBuffer[i : i+popWin])
 			bf := sd.buffer[blockNum*uint64(sd.bfSize) : (blockNum+1)*uint64(sd.bfSize)] // buffer to be filled
 			bitsSet := bfSha1Insert(bf, sha1Hash)
 			if bitsSet == 0 { // Avoid potentially repetitive features
@@ -157,117 +190,148 @@ func (sd *sdbf) generateBlockHash(fileBuffer []uint8, blockNum uint64, chunkScor
 	sd.elemCounts[blockNum] = uint16(hashCnt)
 }
 
-// generateChunkSdbf generate Sdbf hash for a buffer in the stream mode.
-func (sd *sdbf) generateChunkSdbf(fileBuffer []uint8, chunkSize uint64) {
-	if chunkSize <= uint64(PopWinSize) {
-		panic("chunkSize <= popWinSize")
-	}
-
-	fileSize := uint64(len(fileBuffer))
-	buffSize := ((fileSize >> 11) + 1) << 8 // Estimate sdbf size (reallocate later)
-	sd.buffer = make([]uint8, buffSize)
-
-	// Chunk-based computation
-	qt := fileSize / chunkSize
-	rem := fileSize % chunkSize
+// generateChunkSdbf generate Sdbf hash for a chunk in the stream mode, whose ranks are already generated.
+// Scores are accumulated in chunkScores, which is shared between all the chunks of the input.
+func (sd *sdbf) generateChunkSdbf(chunkBuffer []uint8, chunkRanks []uint16, chunkScores []uint16) error {
+	chunkSize := uint64(len(chunkBuffer))
+	sd.origFileSize += chunkSize
 
-	var chunkPos uint64
-	chunkRanks := make([]uint16, chunkSize)
-	chunkScores := make([]uint16, chunkSize)
-
-	for i := uint64(0); i < qt; i++ {
-		sd.generateChunkRanks(fileBuffer[chunkSize*i:chunkSize*(i+1)], chunkRanks)
-		sd.generateChunkScores(chunkRanks, chunkSize, chunkScores, nil)
-		sd.generateChunkHash(fileBuffer, chunkPos, chunkScores, chunkSize)
-		chunkPos += chunkSize
-	}
-	if rem > 0 {
-		sd.generateChunkRanks(fileBuffer[qt*chunkSize:], chunkRanks)
-		sd.generateChunkScores(chunkRanks, rem, chunkScores, nil)
-		sd.generateChunkHash(fileBuffer, chunkPos, chunkScores, rem)
+	// Estimate sdbf size of the chunk (trim later)
+	buffSize := (uint64(sd.bfCount) + (chunkSize >> 11) + 1) * uint64(sd.bfSize)
+	if buffSize > uint64(len(sd.buffer)) {
+		sd.buffer = append(sd.buffer, make([]uint8, buffSize-uint64(len(sd.buffer)))...)
 	}
 
+	sd.generateChunkScores(chunkRanks, chunkSize, chunkScores, nil)
+	return sd.generateChunkHash(chunkBuffer, chunkScores, chunkSize)
+}
+
+// trimChunkSdbf completes a Sdbf generated in the stream mode.
+func (sd *sdbf) trimChunkSdbf() {
 	// Chop off last buffer if its membership is too low (eliminates some FPs)
 	if sd.bfCount > 1 && sd.lastCount < sd.maxElem/8 {
 		sd.bfCount--
 		sd.lastCount = sd.maxElem
 	}
+	if sd.searchIndexesResults != nil {
+		sd.searchIndexesResults = sd.searchIndexesResults[:sd.bfCount]
+	}
 
 	// Trim buffer allocation to size
-	if uint64(sd.bfCount)*uint64(sd.bfSize) < buffSize {
-		sd.buffer = sd.buffer[:sd.bfCount*sd.bfSize]
-	}
+	sd.buffer = sd.buffer[:sd.bfCount*sd.bfSize]
 }
 
-// generateSingleBlockSdbf is the worker for multi goroutine block hash generation.
-func (sd *sdbf) generateSingleBlockSdbf(fileBuffer []uint8, blockNum uint64, ch chan bool) {
+// generateSingleBlockSdbf digests a single block in dd-mode. chunkRanks and chunkScores are scratch buffers of
+// block size, which are cleared before being used, so they can be reused between blocks by the same worker.
+func (sd *sdbf) generateSingleBlockSdbf(fileBuffer []uint8, blockNum uint64, chunkRanks []uint16,
+	chunkScores []uint16) {
 	blockSize := uint64(sd.ddBlockSize)
 	var sum, allowed uint32
 	var scoreHistogram [66]int32
-	chunkRanks := make([]uint16, blockSize)
-	chunkScores := make([]uint16, blockSize)
+	memsetU16(chunkRanks, 0)
+	memsetU16(chunkScores, 0)
 
 	sd.generateChunkRanks(fileBuffer, chunkRanks)
 	sd.generateChunkScores(chunkRanks, blockSize, chunkScores, scoreHistogram[:])
 	var k uint32
-	for k = 65; k >= Threshold; k-- {
-		if sum <= MaxElemDd && (sum+uint32(scoreHistogram[k]) > MaxElemDd) {
+	for k = 65; k >= sd.params.Threshold; k-- {
+		if sum <= sd.maxElem && (sum+uint32(scoreHistogram[k]) > sd.maxElem) {
 			break
 		}
 		sum += uint32(scoreHistogram[k])
 	}
-	allowed = MaxElemDd - sum
+	allowed = sd.maxElem - sum
 	sd.generateBlockHash(fileBuffer, blockNum, chunkScores, 0, k, int32(allowed))
-
-	ch <- true
 }
 
-// Sdbf hash for a buffer in dd-mode.
-func (sd *sdbf) generateBlockSdbf(fileBuffer []uint8, ) {
+// generateBlockSdbf generate Sdbf hash for a window of blocks in dd-mode, digesting the blocks with a pool of at most
+// concurrency workers, or a worker for each usable CPU if concurrency is not positive.
+// The remainder of the window is digested only if it is at least MinFileSize long, so only the last window
+// of the input can have a size which is not a multiple of the block size.
+// It returns the error of ctx if it is cancelled before all the blocks are digested.
+func (sd *sdbf) generateBlockSdbf(ctx context.Context, window []uint8, concurrency int) error {
 	blockSize := uint64(sd.ddBlockSize)
-	qt := uint64(len(fileBuffer)) / blockSize
-	rem := uint64(len(fileBuffer)) % blockSize
+	qt := uint64(len(window)) / blockSize
+	rem := uint64(len(window)) % blockSize
+	sd.origFileSize += uint64(len(window))
 
+	blockCount := qt
+	if rem >= MinFileSize {
+		blockCount++
+	}
+	firstBlock := uint64(sd.bfCount)
+	sd.bfCount += uint32(blockCount)
+	sd.buffer = append(sd.buffer, make([]uint8, blockCount*uint64(sd.bfSize))...)
+	sd.elemCounts = append(sd.elemCounts, make([]uint16, blockCount)...)
 	if sd.searchIndexes != nil {
-		blockCount := qt
-		if rem >= MinFileSize {
-			blockCount++
-		}
-		sd.searchIndexesResults = make([][]uint32, blockCount)
+		sd.searchIndexesResults = append(sd.searchIndexesResults, make([][]uint32, blockCount)...)
 	}
 
-	ch := make(chan bool, qt)
-	for i := uint64(0); i < qt; i++ {
-		go sd.generateSingleBlockSdbf(fileBuffer[blockSize*i:blockSize*(i+1)], i, ch)
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	if uint64(concurrency) > qt {
+		concurrency = int(qt)
+	}
+	blocks := make(chan uint64)
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for w := 0; w < concurrency; w++ {
+		go func() {
+			defer wg.Done()
+			chunkRanks := make([]uint16, blockSize)
+			chunkScores := make([]uint16, blockSize)
+			for i := range blocks {
+				sd.generateSingleBlockSdbf(window[blockSize*i:blockSize*(i+1)], firstBlock+i, chunkRanks, chunkScores)
+			}
+		}()
 	}
-	for i := uint64(0); i < qt; i++ {
-		<-ch
+	for i := uint64(0); i < qt && ctx.Err() == nil; i++ {
+		blocks <- i
+	}
+	close(blocks)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
 	if rem >= MinFileSize {
 		chunkRanks := make([]uint16, blockSize)
 		chunkScores := make([]uint16, blockSize)
 
-		remBuffer := fileBuffer[blockSize*qt : blockSize*qt+rem]
+		remBuffer := window[blockSize*qt : blockSize*qt+rem]
 		sd.generateChunkRanks(remBuffer, chunkRanks)
 		sd.generateChunkScores(chunkRanks, rem, chunkScores, nil)
-		sd.generateBlockHash(remBuffer, qt, chunkScores, uint32(rem), Threshold, int32(sd.maxElem))
+		sd.generateBlockHash(remBuffer, firstBlock+qt, chunkScores, uint32(rem), sd.params.Threshold,
+			int32(sd.maxElem))
 	}
-}
 
-// sdbfScore calculates the score between two Sdbf.
-func (sd *sdbf) sdbfScore(sdbf1 *sdbf, sdbf2 *sdbf, sample uint32) int {
-	var maxScore float64
-	var scoreSum float64 = -1
-	var bfCount1 uint32
+	return nil
+}
 
-	if sdbf1.hamming == nil {
-		sdbf1.computeHamming()
-	}
-	if sdbf2.hamming == nil {
-		sdbf2.computeHamming()
+// sdbfScore calculates the score between two Sdbf. If sample is greater than 0, at most sample filters of the
+// smaller Sdbf are compared: the filters are split in sample equal parts and a filter is picked from each part with
+// a random generator initialized with seed. If match is not nil, it is called for each compared filter of sdbf1 with
+// the index of the best matching filter of sdbf2 and their score.
+func (sd *sdbf) sdbfScore(sdbf1 *sdbf, sdbf2 *sdbf, sample uint32, seed int64,
+	match func(index1, index2 uint32, score float64)) int {
+	sdbf1, sdbf2, bfCount1, swapped := sd.sdbfScoreOrder(sdbf1, sdbf2, sample)
+	if swapped && match != nil {
+		swappedMatch := match
+		match = func(index1, index2 uint32, score float64) {
+			swappedMatch(index2, index1, score)
+		}
 	}
 
+	return sd.sdbfDirectedScore(sdbf1, sdbf2, bfCount1, seed, sd.sdbfMaxScore, match)
+}
+
+// sdbfScoreOrder returns the two Sdbf in the order used to calculate their score, with the number of filters
+// of the first Sdbf to compare. The Sdbf with less filters is compared against the other.
+func (sd *sdbf) sdbfScoreOrder(sdbf1 *sdbf, sdbf2 *sdbf, sample uint32) (*sdbf, *sdbf, uint32, bool) {
+	var bfCount1 uint32
+	var swapped bool
+
 	if sample > 0 && sdbf1.bfCount > sample { // if sampling, set sample count here
 		bfCount1 = sample
 	} else {
@@ -278,22 +342,36 @@ func (sd *sdbf) sdbfScore(sdbf1 *sdbf, sdbf2 *sdbf, sample uint32) int {
 		(sdbf1.getElemCount(uint64(bfCount1)-1) > sdbf2.getElemCount(uint64(sdbf2.bfCount)-1) &&
 			strings.Compare(sdbf1.hashName, sdbf2.hashName) > 0)) {
 		sdbf1, sdbf2 = sdbf2, sdbf1
+		swapped = true
 		bfCount1 = sdbf1.bfCount
+		if sample > 0 && bfCount1 > sample {
+			bfCount1 = sample
+		}
 	}
 
+	return sdbf1, sdbf2, bfCount1, swapped
+}
+
+// sdbfDirectedScore calculates the score of the filters of sdbf1 found in sdbf2, using maxScore to score each
+// filter of sdbf1. If bfCount1 is lower than the number of filters of sdbf1, bfCount1 filters are sampled with
+// a random generator initialized with seed.
+func (sd *sdbf) sdbfDirectedScore(sdbf1 *sdbf, sdbf2 *sdbf, bfCount1 uint32, seed int64,
+	maxScore func(refSdbf *sdbf, refIndex uint32, targetSdbf *sdbf) (float64, uint32),
+	match func(index1, index2 uint32, score float64)) int {
+	var scoreSum float64 = -1
+
 	var spartsect uint32
-	for i := uint32(0); i < bfCount1; i++ {
-		var randOffset uint32 = 1
-		if sample > 0 && bfCount1 > sample {
-			randOffset = rand.Uint32() % (sdbf1.bfCount / sample)
+	for _, refIndex := range sampleFilters(sdbf1.bfCount, bfCount1, seed) {
+		filterScore, maxIndex := maxScore(sdbf1, refIndex, sdbf2)
+		if match != nil && filterScore > 0 {
+			match(refIndex, maxIndex, filterScore)
 		}
-		maxScore = sd.sdbfMaxScore(sdbf1, i*randOffset, sdbf2)
 		if scoreSum < 0 {
-			scoreSum = maxScore
+			scoreSum = filterScore
 		} else {
-			scoreSum += maxScore
+			scoreSum += filterScore
 		}
-		if sdbf1.getElemCount(uint64(i)) < minElemCount {
+		if sdbf1.getElemCount(uint64(refIndex)) < minElemCount {
 			spartsect++
 		}
 	}
@@ -306,22 +384,110 @@ func (sd *sdbf) sdbfScore(sdbf1 *sdbf, sdbf2 *sdbf, sample uint32) int {
 		scoreSum--
 	}
 
+	return averageScore(scoreSum, denominator)
+}
+
+// sdbfThresholdScore calculates the score between two Sdbf like sdbfScore, but stops as soon as the score can be
+// decided against threshold. Before comparing a filter, the bounds of the score are calculated from the scores of the
+// filters already compared and the bounds of the others given by sdbfMaxScoreUpperBound. If the upper bound is lower
+// than threshold, it is returned. If stopAbove is true and the lower bound is greater or equal than threshold,
+// the lower bound is returned. Otherwise, the returned score is the same of sdbfScore.
+// A filter without comparable filters in the other Sdbf scores -1, which resets the running sum of
+// sdbfDirectedScore instead of decreasing it, so when any bound is negative the sum can't be bounded and the full
+// score is calculated.
+func (sd *sdbf) sdbfThresholdScore(sdbf1 *sdbf, sdbf2 *sdbf, sample uint32, seed int64, threshold int,
+	stopAbove bool) int {
+	sdbf1, sdbf2, bfCount1, _ := sd.sdbfScoreOrder(sdbf1, sdbf2, sample)
+	refIndexes := sampleFilters(sdbf1.bfCount, bfCount1, seed)
+
+	bounds := make([]float64, len(refIndexes))
+	var upperSum float64 // upper bound of the sum of the scores of the filters not yet compared
+	var spartsect uint32
+	var negativeBound bool
+	for i, refIndex := range refIndexes {
+		bounds[i], _ = sd.sdbfMaxScoreUpperBound(sdbf1, refIndex, sdbf2)
+		upperSum += bounds[i]
+		negativeBound = negativeBound || bounds[i] < 0
+		if sdbf1.getElemCount(uint64(refIndex)) < minElemCount {
+			spartsect++
+		}
+	}
+	denominator := bfCount1
+	if bfCount1 > 1 {
+		denominator -= spartsect
+	}
+	// if all the filters are too sparse to be compared there is nothing to skip
+	if denominator == 0 || negativeBound {
+		return sd.sdbfDirectedScore(sdbf1, sdbf2, bfCount1, seed, sd.sdbfMaxScore, nil)
+	}
+
+	var scoreSum float64 = -1
+	for i, refIndex := range refIndexes {
+		var partialSum float64
+		if i > 0 {
+			partialSum = scoreSum
+		}
+		if upper := averageScore(partialSum+upperSum+scoreBoundSlack, denominator); upper < threshold {
+			return upper
+		}
+		if lower := averageScore(partialSum-scoreBoundSlack, denominator); stopAbove && lower >= threshold {
+			return lower
+		}
+
+		filterScore, _ := sd.sdbfMaxScore(sdbf1, refIndex, sdbf2)
+		if scoreSum < 0 {
+			scoreSum = filterScore
+		} else {
+			scoreSum += filterScore
+		}
+		upperSum -= bounds[i]
+	}
+
+	return averageScore(scoreSum, denominator)
+}
+
+// averageScore returns the score (0-100) of the filters whose scores sum to scoreSum, or -1 if scoreSum is negative.
+func averageScore(scoreSum float64, denominator uint32) int {
 	if scoreSum < 0 {
 		return -1
 	}
-
 	return int(math.Round(100.0 * scoreSum / float64(denominator)))
 }
 
-// sdbfMaxScore calculates the maximum match (0-100) of a single block.
-func (sd *sdbf) sdbfMaxScore(refSdbf *sdbf, refIndex uint32, targetSdbf *sdbf) float64 {
+// sampleFilters returns the indexes of the filters to compare of a Sdbf with bfCount filters. If sample is lower than
+// bfCount, the filters are split in sample equal parts and a filter is picked from each part with a random generator
+// initialized with seed; otherwise all the filters are returned.
+func sampleFilters(bfCount uint32, sample uint32, seed int64) []uint32 {
+	if sample > bfCount {
+		sample = bfCount
+	}
+	indexes := make([]uint32, sample)
+	var r *rand.Rand
+	if sample < bfCount {
+		r = rand.New(rand.NewSource(seed))
+	}
+	for i := uint32(0); i < sample; i++ {
+		indexes[i] = i
+		if r != nil {
+			start := uint64(i) * uint64(bfCount) / uint64(sample)
+			end := uint64(i+1) * uint64(bfCount) / uint64(sample)
+			indexes[i] = uint32(start + uint64(r.Int63n(int64(end-start))))
+		}
+	}
+	return indexes
+}
+
+// sdbfMaxScore calculates the maximum match (0-1) of a single block, and returns it with the index of the
+// best matching filter of targetSdbf.
+func (sd *sdbf) sdbfMaxScore(refSdbf *sdbf, refIndex uint32, targetSdbf *sdbf) (float64, uint32) {
 	var score float64
 	var maxScore float64 = -1
+	var maxIndex uint32
 	bfSize := refSdbf.bfSize
 
 	s1 := refSdbf.getElemCount(uint64(refIndex))
 	if s1 < minElemCount {
-		return 0
+		return 0, 0
 	}
 	bf1 := refSdbf.buffer[refIndex*bfSize:]
 	e1Cnt := refSdbf.hamming[refIndex]
@@ -356,22 +522,54 @@ func (sd *sdbf) sdbfMaxScore(refSdbf *sdbf, refIndex uint32, targetSdbf *sdbf) f
 		}
 		if score > maxScore {
 			maxScore = score
+			maxIndex = i
 		}
 	}
 
-	return maxScore
+	return maxScore, maxIndex
 }
 
-// checkIndexes checks if some of the search blooms filters match.
-func (sd *sdbf) checkIndexes(sha1 []uint32, matches []uint32) bool {
-	any := false
+// sdbfMaxScoreUpperBound calculates an upper bound of sdbfMaxScore, using only the hamming weights and the elements
+// count of the filters. The match of two filters can't exceed the minimum of their hamming weights, so a filter can
+// match only if the minimum hamming weight is above the cut off. The score of sdbfMaxScore is normalized by the same
+// minimum, so the best score the hamming weights allow is either 0 or 1, and the search stops at the first target
+// filter which allows 1. Bounding the match with the weights of smaller sections of the filters is not worth it:
+// the bound of unrelated filters stays close to 1, and calculating it for every target filter costs more than the
+// comparisons it skips. The returned index is always 0.
+func (sd *sdbf) sdbfMaxScoreUpperBound(refSdbf *sdbf, refIndex uint32, targetSdbf *sdbf) (float64, uint32) {
+	var maxScore float64 = -1
 
-	for i := 0; i < len(sd.searchIndexes); i++ {
-		if sd.searchIndexes[i].querySha1(sha1) {
-			matches[i]++
-			any = true
+	s1 := refSdbf.getElemCount(uint64(refIndex))
+	if s1 < minElemCount {
+		return 0, 0
+	}
+	e1Cnt := refSdbf.hamming[refIndex]
+	for i := uint32(0); i < targetSdbf.bfCount; i++ {
+		s2 := targetSdbf.getElemCount(uint64(i))
+		if refSdbf.bfCount >= 1 && s2 < minElemCount {
+			continue
 		}
+		e2Cnt := targetSdbf.hamming[i]
+		maxEst := e1Cnt
+		if e2Cnt < maxEst {
+			maxEst = e2Cnt
+		}
+		var cutOff uint32
+		if !refSdbf.fastMode {
+			cutOff = cutoffs256[4096/(s1+s2)]
+		} else {
+			cutOff = cutoffs64[1024/(s1+s2)]
+		}
+		if uint32(maxEst) > cutOff {
+			return 1, 0
+		}
+		maxScore = 0
 	}
 
-	return any
+	return maxScore, 0
+}
+
+// checkIndexes checks if some of the search blooms filters match.
+func (sd *sdbf) checkIndexes(sha1 []uint32, matches []uint32) bool {
+	return sd.searchIndexes.searchSha1(sha1, matches)
 }
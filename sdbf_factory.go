@@ -1,6 +1,8 @@
 package sdhash
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -24,22 +26,48 @@ type SdbfFactory interface {
 	// Without setting a value the searching operation during the digesting process is disabled.
 	WithSearchIndexes(searchIndexes []BloomFilter) SdbfFactory
 
+	// WithSearchMultiIndex sets a MultiIndex which is checked for similarity during digesting process, like
+	// WithSearchIndexes. It replaces the list of BloomFilter set by WithSearchIndexes.
+	WithSearchMultiIndex(searchIndexes MultiIndex) SdbfFactory
+
 	// WithName sets the name of the Sdbf in the output.
 	WithName(name string) SdbfFactory
 
+	// WithParams sets the parameters used to generate the Sdbf.
+	// Without setting a value the factory uses DefaultParams.
+	WithParams(params Params) SdbfFactory
+
+	// WithProgress sets a function which is called during the digesting process with the number of bytes
+	// processed and the number of bloom filters produced so far.
+	WithProgress(progress func(bytes uint64, filters uint32)) SdbfFactory
+
+	// WithConcurrency sets the maximum number of goroutines which digest the blocks in block mode.
+	// The default value of 0 uses a goroutine for each usable CPU, as reported by runtime.GOMAXPROCS.
+	WithConcurrency(concurrency int) SdbfFactory
+
 	// Compute start the digesting process and provide a Sdbf with the result.
-	Compute() Sdbf
+	// The source is read incrementally, so only a bounded window of the input is kept in memory.
+	Compute() (Sdbf, error)
+
+	// ComputeContext start the digesting process and provide a Sdbf with the result, like Compute.
+	// The digesting process is stopped between chunks and blocks when ctx is cancelled, and the error
+	// of ctx is returned.
+	ComputeContext(ctx context.Context) (Sdbf, error)
 }
 
 type sdbfFactory struct {
-	buffer        []uint8
+	open          func() (io.ReadCloser, error)
+	params        Params
 	ddBlockSize   uint32
 	initialIndex  BloomFilter
-	searchIndexes []BloomFilter
+	searchIndexes MultiIndex
 	name          string
+	progress      func(bytes uint64, filters uint32)
+	concurrency   int
 }
 
 // CreateSdbfFromFilename returns a factory which can produce a Sdbf of a file.
+// The file is opened and read only when the digest is computed.
 func CreateSdbfFromFilename(filename string) (SdbfFactory, error) {
 	info, err := os.Stat(filename)
 	if err != nil {
@@ -49,38 +77,55 @@ func CreateSdbfFromFilename(filename string) (SdbfFactory, error) {
 		return nil, fmt.Errorf("%s is not a regular file", filename)
 	}
 	if info.Size() < MinFileSize {
-		return nil, fmt.Errorf("%s is too small", filename)
+		return nil, fmt.Errorf("%s: %w", filename, ErrInputTooSmall)
 	}
-	if buffer, err := ioutil.ReadFile(filename); err == nil {
-		if sdbf, err := CreateSdbfFromBytes(buffer); err != nil {
-			panic(err)
-		} else {
-			sdbf.WithName(path.Base(filename))
-			return sdbf, nil
-		}
-	} else {
-		return nil, err
+	sdf := &sdbfFactory{
+		open: func() (io.ReadCloser, error) {
+			return os.Open(filename)
+		},
+		params: DefaultParams(),
 	}
+	sdf.WithName(path.Base(filename))
+
+	return sdf, nil
 }
 
 // CreateSdbfFromBytes returns a factory which can produce a Sdbf from a bytes buffer.
 func CreateSdbfFromBytes(buffer []uint8) (SdbfFactory, error) {
 	if len(buffer) < MinFileSize {
-		return nil, fmt.Errorf("the length of buffer must be greater than %d", MinFileSize)
+		return nil, fmt.Errorf("the length of buffer must be greater than %d: %w", MinFileSize, ErrInputTooSmall)
 	}
 	return &sdbfFactory{
-		buffer: buffer,
+		open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(buffer)), nil
+		},
+		params: DefaultParams(),
 	}, nil
 }
 
 // CreateSdbfFromReader returns a factory which can produce a Sdbf from a io.Reader.
+// The reader is consumed while the digest is computed, without buffering the whole input, so the factory can
+// compute a single digest: the following calls to Compute return ErrSourceConsumed.
 func CreateSdbfFromReader(r io.Reader) (SdbfFactory, error) {
-	var buffer []byte
-	var err error
-	if buffer, err = ioutil.ReadAll(r); err != nil {
+	head := make([]uint8, MinFileSize)
+	if n, err := io.ReadFull(r, head); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("the length of buffer must be greater than %d: %w", MinFileSize, ErrInputTooSmall)
+	} else if err != nil {
 		return nil, err
+	} else {
+		head = head[:n]
 	}
-	return CreateSdbfFromBytes(buffer)
+	var consumed bool
+	return &sdbfFactory{
+		open: func() (io.ReadCloser, error) {
+			if consumed {
+				return nil, ErrSourceConsumed
+			}
+			consumed = true
+			return ioutil.NopCloser(io.MultiReader(bytes.NewReader(head), r)), nil
+		},
+		params: DefaultParams(),
+	}, nil
 }
 
 func (sdf *sdbfFactory) WithBlockSize(blockSize uint32) SdbfFactory {
@@ -94,6 +139,15 @@ func (sdf *sdbfFactory) WithInitialIndex(initialIndex BloomFilter) SdbfFactory {
 }
 
 func (sdf *sdbfFactory) WithSearchIndexes(searchIndexes []BloomFilter) SdbfFactory {
+	if searchIndexes == nil {
+		sdf.searchIndexes = nil
+	} else {
+		sdf.searchIndexes = bloomFilterList(searchIndexes)
+	}
+	return sdf
+}
+
+func (sdf *sdbfFactory) WithSearchMultiIndex(searchIndexes MultiIndex) SdbfFactory {
 	sdf.searchIndexes = searchIndexes
 	return sdf
 }
@@ -103,6 +157,66 @@ func (sdf *sdbfFactory) WithName(name string) SdbfFactory {
 	return sdf
 }
 
-func (sdf *sdbfFactory) Compute() Sdbf {
-	return createSdbf(sdf.buffer, sdf.ddBlockSize, sdf.initialIndex, sdf.searchIndexes, sdf.name)
+func (sdf *sdbfFactory) WithParams(params Params) SdbfFactory {
+	sdf.params = params
+	return sdf
+}
+
+func (sdf *sdbfFactory) WithProgress(progress func(bytes uint64, filters uint32)) SdbfFactory {
+	sdf.progress = progress
+	return sdf
+}
+
+func (sdf *sdbfFactory) WithConcurrency(concurrency int) SdbfFactory {
+	sdf.concurrency = concurrency
+	return sdf
+}
+
+func (sdf *sdbfFactory) Compute() (Sdbf, error) {
+	return sdf.ComputeContext(context.Background())
+}
+
+func (sdf *sdbfFactory) ComputeContext(ctx context.Context) (Sdbf, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := sdf.params.validate(); err != nil {
+		return nil, err
+	}
+	r, err := sdf.open()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = r.Close()
+	}()
+
+	h := &hasher{
+		params:        sdf.params,
+		ddBlockSize:   sdf.ddBlockSize,
+		initialIndex:  sdf.initialIndex,
+		searchIndexes: sdf.searchIndexes,
+		name:          sdf.name,
+		progress:      sdf.progress,
+		concurrency:   sdf.concurrency,
+	}
+	buffer := make([]uint8, 32*kB)
+	for {
+		n, err := r.Read(buffer)
+		if n > 0 {
+			if _, err := h.write(ctx, buffer[:n]); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return h.finish(ctx)
 }
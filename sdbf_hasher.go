@@ -0,0 +1,276 @@
+package sdhash
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Hasher computes the Sdbf of the data written to it, chunk by chunk, without staging the whole input.
+// It can be used as the destination of io.Copy, io.TeeReader or io.MultiWriter.
+type Hasher interface {
+	io.Writer
+
+	// WithBlockSize sets the block size for the block mode.
+	// The default value of 0 involves in a Sdbf generated in stream mode.
+	// The settings of the Hasher must be changed before writing any data.
+	WithBlockSize(blockSize uint32) Hasher
+
+	// WithInitialIndex sets the initial BloomFilter index.
+	// Without setting an initial index the hasher creates a new empty BloomFilter.
+	WithInitialIndex(initialIndex BloomFilter) Hasher
+
+	// WithSearchIndexes sets a list of BloomFilter which are checked for similarity during digesting process.
+	// Without setting a value the searching operation during the digesting process is disabled.
+	WithSearchIndexes(searchIndexes []BloomFilter) Hasher
+
+	// WithSearchMultiIndex sets a MultiIndex which is checked for similarity during digesting process, like
+	// WithSearchIndexes. It replaces the list of BloomFilter set by WithSearchIndexes.
+	WithSearchMultiIndex(searchIndexes MultiIndex) Hasher
+
+	// WithName sets the name of the Sdbf in the output.
+	WithName(name string) Hasher
+
+	// WithParams sets the parameters used to generate the Sdbf.
+	// Without setting a value the hasher uses DefaultParams.
+	WithParams(params Params) Hasher
+
+	// WithConcurrency sets the maximum number of goroutines which digest the blocks in block mode.
+	// The default value of 0 uses a goroutine for each usable CPU, as reported by runtime.GOMAXPROCS.
+	WithConcurrency(concurrency int) Hasher
+
+	// Sum completes the digesting process and provide a Sdbf with the result.
+	// Once Sum is called, the Hasher does not accept more data until it is Reset.
+	// It returns ErrInputTooSmall if less than MinFileSize bytes were written.
+	Sum() (Sdbf, error)
+
+	// Reset discards the data written so far, keeping the settings of the Hasher.
+	Reset()
+}
+
+type hasher struct {
+	params        Params
+	ddBlockSize   uint32
+	initialIndex  BloomFilter
+	searchIndexes MultiIndex
+	name          string
+	concurrency   int
+
+	sd          *sdbf     // sdbf being digested; nil until data is written
+	chunk       []uint8   // current chunk in stream mode, or current window of blocks in block mode
+	chunkRanks  []uint16  // ranks of the current chunk in stream mode
+	chunkScores []uint16  // scores of the chunks in stream mode, accumulated between chunks
+	ranks       rankState // rolling entropy state of the current chunk in stream mode
+	sum         *sdbf     // result of the digesting process; nil until Sum is called
+
+	progress func(bytes uint64, filters uint32) // called after each digested chunk or window; can be nil
+}
+
+// NewHasher returns a Hasher which produces a Sdbf of the data written to it.
+func NewHasher() Hasher {
+	return &hasher{
+		params: DefaultParams(),
+	}
+}
+
+func (h *hasher) WithBlockSize(blockSize uint32) Hasher {
+	h.ddBlockSize = blockSize
+	return h
+}
+
+func (h *hasher) WithInitialIndex(initialIndex BloomFilter) Hasher {
+	h.initialIndex = initialIndex
+	return h
+}
+
+func (h *hasher) WithSearchIndexes(searchIndexes []BloomFilter) Hasher {
+	if searchIndexes == nil {
+		h.searchIndexes = nil
+	} else {
+		h.searchIndexes = bloomFilterList(searchIndexes)
+	}
+	return h
+}
+
+func (h *hasher) WithSearchMultiIndex(searchIndexes MultiIndex) Hasher {
+	h.searchIndexes = searchIndexes
+	return h
+}
+
+func (h *hasher) WithName(name string) Hasher {
+	h.name = strings.ReplaceAll(name, ":", "$")
+	return h
+}
+
+func (h *hasher) WithParams(params Params) Hasher {
+	h.params = params
+	return h
+}
+
+func (h *hasher) WithConcurrency(concurrency int) Hasher {
+	h.concurrency = concurrency
+	return h
+}
+
+func (h *hasher) Write(p []uint8) (int, error) {
+	return h.write(context.Background(), p)
+}
+
+func (h *hasher) Sum() (Sdbf, error) {
+	return h.finish(context.Background())
+}
+
+func (h *hasher) Reset() {
+	h.sd = nil
+	h.sum = nil
+	h.chunk = h.chunk[:0]
+	h.chunkRanks = nil
+	h.chunkScores = nil
+	h.ranks = rankState{}
+}
+
+// write appends p to the data to digest, digesting each chunk or window as soon as it is complete.
+// The digesting process is stopped if ctx is cancelled.
+func (h *hasher) write(ctx context.Context, p []uint8) (int, error) {
+	if h.sum != nil {
+		return 0, errors.New("hasher already summed")
+	}
+	if err := h.init(); err != nil {
+		return 0, err
+	}
+
+	chunkSize := h.chunkSize()
+	written := 0
+	for written < len(p) {
+		n := chunkSize - len(h.chunk)
+		if n > len(p)-written {
+			n = len(p) - written
+		}
+		h.appendChunk(p[written:written+n], chunkSize)
+		written += n
+
+		if h.ddBlockSize == 0 {
+			h.sd.updateChunkRanks(&h.ranks, h.chunk, h.chunkRanks)
+		}
+		if len(h.chunk) == chunkSize {
+			if err := h.digestChunk(ctx); err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// finish digests the remaining data and completes the digesting process.
+func (h *hasher) finish(ctx context.Context) (*sdbf, error) {
+	if h.sum != nil {
+		return h.sum, nil
+	}
+	if err := h.init(); err != nil {
+		return nil, err
+	}
+	if h.sd.origFileSize+uint64(len(h.chunk)) < MinFileSize {
+		return nil, ErrInputTooSmall
+	}
+
+	if len(h.chunk) > 0 {
+		if err := h.digestChunk(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if h.ddBlockSize == 0 {
+		h.sd.trimChunkSdbf()
+	}
+	h.sd.computeHamming()
+
+	h.sum = h.sd
+	h.sd = nil
+	h.chunk = nil
+	h.chunkRanks = nil
+	h.chunkScores = nil
+
+	return h.sum, nil
+}
+
+// init creates the sdbf to digest, if not already created.
+func (h *hasher) init() error {
+	if h.sd != nil {
+		return nil
+	}
+	sd, err := newSdbf(h.params, h.ddBlockSize, h.initialIndex, h.searchIndexes, h.name)
+	if err != nil {
+		return err
+	}
+	h.sd = sd
+	return nil
+}
+
+// chunkSize returns the size of the chunks (stream mode) or windows (block mode) of the input digested at once.
+func (h *hasher) chunkSize() int {
+	if h.ddBlockSize == 0 {
+		return streamChunkSize
+	}
+	if windowSize := blockWindowSize / int(h.ddBlockSize) * int(h.ddBlockSize); windowSize > 0 {
+		return windowSize
+	}
+	return int(h.ddBlockSize)
+}
+
+// appendChunk appends data to the current chunk, growing the chunk buffers up to chunkSize.
+func (h *hasher) appendChunk(data []uint8, chunkSize int) {
+	if len(h.chunk)+len(data) > cap(h.chunk) {
+		newCap := 2 * cap(h.chunk)
+		if newCap < len(h.chunk)+len(data) {
+			newCap = len(h.chunk) + len(data)
+		}
+		if newCap > chunkSize {
+			newCap = chunkSize
+		}
+		chunk := make([]uint8, len(h.chunk), newCap)
+		copy(chunk, h.chunk)
+		h.chunk = chunk
+	}
+	h.chunk = append(h.chunk, data...)
+
+	// ranks and scores are shared between chunks in stream mode, and are read past the end of the chunk
+	if ranksSize := len(h.chunk) + int(h.params.PopWinSize); h.ddBlockSize == 0 && ranksSize > len(h.chunkRanks) {
+		if ranksSize < 2*len(h.chunkRanks) {
+			ranksSize = 2 * len(h.chunkRanks)
+		}
+		if ranksSize > chunkSize {
+			ranksSize = chunkSize
+		}
+		if ranksSize > len(h.chunkRanks) {
+			chunkRanks := make([]uint16, ranksSize)
+			copy(chunkRanks, h.chunkRanks)
+			h.chunkRanks = chunkRanks
+			chunkScores := make([]uint16, ranksSize)
+			copy(chunkScores, h.chunkScores)
+			h.chunkScores = chunkScores
+		}
+	}
+}
+
+// digestChunk digests the current chunk or window, and starts a new one.
+func (h *hasher) digestChunk(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if h.ddBlockSize == 0 {
+		if err := h.sd.generateChunkSdbf(h.chunk, h.chunkRanks, h.chunkScores); err != nil {
+			return err
+		}
+		h.ranks = rankState{}
+	} else if err := h.sd.generateBlockSdbf(ctx, h.chunk, h.concurrency); err != nil {
+		return err
+	}
+	h.chunk = h.chunk[:0]
+
+	if h.progress != nil {
+		h.progress(h.sd.origFileSize, h.sd.bfCount)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package sdhash
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Reader reads Sdbf from a stream of digests encoded in the text format, one digest per line.
+type Reader interface {
+
+	// Read reads and returns the next Sdbf. Empty lines are skipped.
+	// If there are no more digests to read, Read returns nil and io.EOF.
+	Read() (Sdbf, error)
+
+	// ReadAll reads all the remaining Sdbf.
+	ReadAll() ([]Sdbf, error)
+
+	// Line returns the number of the last line read.
+	Line() int
+}
+
+// Writer writes Sdbf to a stream of digests encoded in the text format, one digest per line.
+type Writer interface {
+
+	// Write writes a Sdbf. Writes are buffered, and Flush must be called to ensure that the Sdbf is written.
+	Write(sdbf Sdbf) error
+
+	// Flush writes any buffered data to the underlying io.Writer.
+	Flush() error
+}
+
+type reader struct {
+	r    *bufio.Reader
+	line int
+}
+
+type writer struct {
+	w *bufio.Writer
+}
+
+// NewReader returns a new Reader that reads from r. There are no limits to the length of the lines.
+func NewReader(r io.Reader) Reader {
+	return &reader{
+		r: bufio.NewReader(r),
+	}
+}
+
+// NewWriter returns a new Writer that writes to w.
+func NewWriter(w io.Writer) Writer {
+	return &writer{
+		w: bufio.NewWriter(w),
+	}
+}
+
+func (r *reader) Read() (Sdbf, error) {
+	for {
+		line, err := r.r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		} else if err == io.EOF && len(line) == 0 {
+			return nil, io.EOF
+		}
+		r.line++
+
+		if line = strings.TrimRight(line, "\r\n"); len(line) == 0 {
+			continue
+		}
+		sdbf, err := ParseSdbfFromString(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", r.line, err)
+		}
+		return sdbf, nil
+	}
+}
+
+func (r *reader) ReadAll() ([]Sdbf, error) {
+	sdbfs := make([]Sdbf, 0)
+	for {
+		sdbf, err := r.Read()
+		if err == io.EOF {
+			return sdbfs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		sdbfs = append(sdbfs, sdbf)
+	}
+}
+
+func (r *reader) Line() int {
+	return r.line
+}
+
+func (w *writer) Write(sdbf Sdbf) error {
+	_, err := w.w.WriteString(sdbf.String())
+	return err
+}
+
+func (w *writer) Flush() error {
+	return w.w.Flush()
+}
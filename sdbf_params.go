@@ -0,0 +1,67 @@
+package sdhash
+
+import (
+	"fmt"
+)
+
+// Params contains the parameters used to generate a Sdbf.
+// Each Sdbf carries the parameters it was generated with, and only Sdbf generated with the same parameters
+// can be compared.
+type Params struct {
+	BfSize         uint32 // BfSize is the size of each bloom filters.
+	PopWinSize     uint32 // PopWinSize is the size of the sliding window used to hash input.
+	MaxElem        uint32 // MaxElem is maximum number of elements in each bloom filter in stream mode.
+	MaxElemDd      uint32 // MaxElemDd is maximum number of elements in each bloom filter in block mode.
+	Threshold      uint32 // Threshold is the minimum value of the score above witch chunks are considered.
+	BlockSize      uint32 // BlockSize is the block size used to generate chunk ranks.
+	EntropyWinSize uint32 // EntropyWinSize is the entropy window size used to generate chunk ranks.
+}
+
+// DefaultParams returns the parameters used by default, which are the same of the original sdhash.
+func DefaultParams() Params {
+	return Params{
+		BfSize:         256,
+		PopWinSize:     64,
+		MaxElem:        160,
+		MaxElemDd:      192,
+		Threshold:      16,
+		BlockSize:      4 * kB,
+		EntropyWinSize: 64,
+	}
+}
+
+// validate checks if the parameters can be used to generate a Sdbf.
+func (p Params) validate() error {
+	if p.BfSize != 256 {
+		return fmt.Errorf("%w: bloom filter size must be 256", ErrInvalidParams)
+	}
+	if p.EntropyWinSize != 64 {
+		return fmt.Errorf("%w: entropy window size must be 64", ErrInvalidParams)
+	}
+	if p.PopWinSize == 0 || p.PopWinSize > 64 {
+		return fmt.Errorf("%w: pop window size must be between 1 and 64", ErrInvalidParams)
+	}
+	if p.Threshold == 0 || p.Threshold > p.PopWinSize {
+		return fmt.Errorf("%w: threshold must be between 1 and pop window size", ErrInvalidParams)
+	}
+	if p.MaxElem == 0 || p.MaxElem > 0xFFFF || p.MaxElemDd == 0 || p.MaxElemDd > 0xFFFF {
+		return fmt.Errorf("%w: max elements must be between 1 and 65535", ErrInvalidParams)
+	}
+	if p.BlockSize == 0 {
+		return fmt.Errorf("%w: block size must be greater than 0", ErrInvalidParams)
+	}
+	return nil
+}
+
+// compatible returns true if the Sdbf generated with p can be compared with the ones generated with other.
+// The maximum number of elements per filter is not considered, because it does not change the selected features.
+func (p Params) compatible(other Params) bool {
+	return p.BfSize == other.BfSize && p.PopWinSize == other.PopWinSize && p.Threshold == other.Threshold &&
+		p.BlockSize == other.BlockSize && p.EntropyWinSize == other.EntropyWinSize
+}
+
+// isDefault returns true if the parameters that are not serialized in the original sdhash header are the
+// default ones, so that the Sdbf can be serialized in the original format.
+func (p Params) isDefault() bool {
+	return p.compatible(DefaultParams())
+}
@@ -0,0 +1,347 @@
+package sdhash
+
+import (
+	"context"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Set is an ordered collection of Sdbf, which can be looked up by name. A Set can have an attached BloomFilter index,
+// that can be used as initial index when digesting the Sdbf to be added to the Set.
+// A Set is safe for concurrent use by multiple goroutines.
+type Set interface {
+
+	// Add appends one or more Sdbf to the Set. Multiple Sdbf with the same name can be present in the same Set.
+	Add(sdbfs ...Sdbf)
+
+	// Remove removes all the Sdbf with the specified name from the Set. Returns the number of Sdbf removed.
+	Remove(name string) int
+
+	// Lookup returns the first Sdbf in the Set with the specified name.
+	Lookup(name string) (Sdbf, bool)
+
+	// Len returns the number of Sdbf in the Set.
+	Len() int
+
+	// Items returns a copy of the Sdbf in the Set, in insertion order.
+	Items() []Sdbf
+
+	// Range calls f sequentially for each Sdbf in the Set, in insertion order. If f returns false, Range stops.
+	// The Set can be modified by f, but Range iterates over the Sdbf present when it was called.
+	Range(f func(sdbf Sdbf) bool)
+
+	// Index returns the BloomFilter index attached to the Set, or nil if the Set has no index.
+	Index() BloomFilter
+
+	// SetIndex attaches a BloomFilter index to the Set.
+	SetIndex(index BloomFilter)
+
+	// CompareAll compares each Sdbf in the Set to every other Sdbf in the Set.
+	// The results with a score greater or equal than threshold are passed to f as soon as they are computed;
+	// the comparisons which can't reach threshold are stopped early.
+	// If f returns an error, the comparison is stopped and the error is returned.
+	CompareAll(threshold int, f ResultFunc) error
+
+	// CompareTo compares each Sdbf in the Set to every Sdbf in the other Set, using CompareSampleSeed with the
+	// specified sample size and seed. The results with a score greater or equal than threshold are passed to f as soon as
+	// they are computed; the comparisons which can't reach threshold are stopped early.
+	// If f returns an error, the comparison is stopped and the error is returned.
+	CompareTo(other Set, threshold int, sample uint32, seed int64, f ResultFunc) error
+
+	// Query compares query to every Sdbf in the Set, and returns the k most similar Sdbf sorted by descending score.
+	// Sdbf with the same score are sorted in insertion order, and Sdbf with a score lower than 1 are not returned.
+	// The comparisons with the Sdbf which can't reach the k best scores found so far are stopped early.
+	Query(query Sdbf, k int) ([]Result, error)
+
+	// String returns the concatenation of the encoded Sdbf in the Set.
+	String() string
+}
+
+// Result is the result of a comparison between a query Sdbf and a target Sdbf.
+type Result struct {
+	Query  Sdbf
+	Target Sdbf
+	Score  int
+}
+
+// ResultFunc is the type of the function called for each Result of a comparison.
+type ResultFunc func(result Result) error
+
+// SendResults returns a ResultFunc which sends the results to ch. If ctx is done before a result is sent,
+// the comparison is stopped and the context error is returned.
+func SendResults(ctx context.Context, ch chan<- Result) ResultFunc {
+	return func(result Result) error {
+		select {
+		case ch <- result:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// CollectResults returns a ResultFunc which appends the results to the slice pointed by results.
+func CollectResults(results *[]Result) ResultFunc {
+	return func(result Result) error {
+		*results = append(*results, result)
+		return nil
+	}
+}
+
+type set struct {
+	items []Sdbf
+	names map[string][]int // positions of the items with the same name
+	index BloomFilter
+	mutex sync.RWMutex
+}
+
+// NewSet creates an empty Set, with an attached BloomFilter index. The index can be nil.
+func NewSet(index BloomFilter) Set {
+	return &set{
+		items: make([]Sdbf, 0),
+		names: make(map[string][]int),
+		index: index,
+	}
+}
+
+func (s *set) Add(sdbfs ...Sdbf) {
+	s.mutex.Lock()
+	for _, sdbf := range sdbfs {
+		s.names[sdbf.Name()] = append(s.names[sdbf.Name()], len(s.items))
+		s.items = append(s.items, sdbf)
+	}
+	s.mutex.Unlock()
+}
+
+func (s *set) Remove(name string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	removed := len(s.names[name])
+	if removed == 0 {
+		return 0
+	}
+	items := make([]Sdbf, 0, len(s.items)-removed)
+	names := make(map[string][]int, len(s.names)-1)
+	for _, sdbf := range s.items {
+		if sdbf.Name() != name {
+			names[sdbf.Name()] = append(names[sdbf.Name()], len(items))
+			items = append(items, sdbf)
+		}
+	}
+	s.items, s.names = items, names
+
+	return removed
+}
+
+func (s *set) Lookup(name string) (Sdbf, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if positions := s.names[name]; len(positions) > 0 {
+		return s.items[positions[0]], true
+	}
+	return nil, false
+}
+
+func (s *set) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return len(s.items)
+}
+
+func (s *set) Items() []Sdbf {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	items := make([]Sdbf, len(s.items))
+	copy(items, s.items)
+	return items
+}
+
+func (s *set) Range(f func(sdbf Sdbf) bool) {
+	for _, sdbf := range s.Items() {
+		if !f(sdbf) {
+			return
+		}
+	}
+}
+
+func (s *set) Index() BloomFilter {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.index
+}
+
+func (s *set) SetIndex(index BloomFilter) {
+	s.mutex.Lock()
+	s.index = index
+	s.mutex.Unlock()
+}
+
+func (s *set) CompareAll(threshold int, f ResultFunc) error {
+	items := s.Items()
+	return compareRows(len(items), func(i int) ([]Result, error) {
+		var results []Result
+		for j := i + 1; j < len(items); j++ {
+			score, err := compareThreshold(items[i], items[j], threshold, 0, DefaultSeed)
+			if err != nil {
+				return nil, err
+			}
+			if score >= threshold {
+				results = append(results, Result{Query: items[i], Target: items[j], Score: score})
+			}
+		}
+		return results, nil
+	}, f)
+}
+
+func (s *set) CompareTo(other Set, threshold int, sample uint32, seed int64, f ResultFunc) error {
+	queries := s.Items()
+	targets := other.Items()
+	return compareRows(len(queries), func(i int) ([]Result, error) {
+		var results []Result
+		for _, target := range targets {
+			score, err := compareThreshold(queries[i], target, threshold, sample, seed)
+			if err != nil {
+				return nil, err
+			}
+			if score >= threshold {
+				results = append(results, Result{Query: queries[i], Target: target, Score: score})
+			}
+		}
+		return results, nil
+	}, f)
+}
+
+func (s *set) Query(query Sdbf, k int) ([]Result, error) {
+	querySd, ok := query.(*sdbf)
+	if !ok || querySd == nil {
+		return nil, ErrIncompatibleDigest
+	}
+
+	if k <= 0 {
+		return []Result{}, nil
+	}
+
+	items := s.Items()
+	// k is not bounded by the caller, so the results are allocated for the items of the set at most
+	capacity := k
+	if len(items) < capacity {
+		capacity = len(items)
+	}
+	results := make([]Result, 0, capacity)
+	for _, item := range items {
+		target, err := querySd.compatibleSdbf(item)
+		if err != nil {
+			return nil, err
+		}
+		minScore := 1
+		if len(results) == k {
+			minScore = results[k-1].Score + 1
+		}
+		score := querySd.sdbfThresholdScore(querySd, target, 0, DefaultSeed, minScore, false)
+		if score < minScore {
+			continue
+		}
+
+		pos := sort.Search(len(results), func(i int) bool {
+			return results[i].Score < score
+		})
+		if len(results) < k {
+			results = append(results, Result{})
+		}
+		copy(results[pos+1:], results[pos:])
+		results[pos] = Result{Query: query, Target: item, Score: score}
+	}
+
+	return results, nil
+}
+
+// compareThreshold compares query to target like CompareSampleSeed, but stops as soon as the score is known to be
+// lower than threshold. The returned score is exact only if it is greater or equal than threshold.
+func compareThreshold(query Sdbf, target Sdbf, threshold int, sample uint32, seed int64) (int, error) {
+	querySd, ok := query.(*sdbf)
+	if !ok || querySd == nil {
+		return 0, ErrIncompatibleDigest
+	}
+	targetSd, err := querySd.compatibleSdbf(target)
+	if err != nil {
+		return 0, err
+	}
+	return querySd.sdbfThresholdScore(querySd, targetSd, sample, seed, threshold, false), nil
+}
+
+func (s *set) String() string {
+	var sb strings.Builder
+	for _, sdbf := range s.Items() {
+		sb.WriteString(sdbf.String())
+	}
+	return sb.String()
+}
+
+type rowResults struct {
+	results []Result
+	err     error
+}
+
+type rowJob struct {
+	row int
+	out chan rowResults
+}
+
+// compareRows computes the rows of a comparison matrix with a pool of workers, one for each usable CPU.
+// compareRow is called concurrently and returns the results of a row. The results are passed to f from the calling
+// goroutine, in row order, so the order of the results is the same of a sequential comparison.
+// The rows computed and not yet passed to f are bounded by twice the number of workers.
+func compareRows(rows int, compareRow func(row int) ([]Result, error), f ResultFunc) error {
+	workers := runtime.GOMAXPROCS(0)
+	jobs := make(chan rowJob)
+	pending := make(chan chan rowResults, 2*workers)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(jobs)
+		defer close(pending)
+		for row := 0; row < rows; row++ {
+			out := make(chan rowResults, 1)
+			select {
+			case pending <- out:
+			case <-done:
+				return
+			}
+			select {
+			case jobs <- rowJob{row: row, out: out}:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range jobs {
+				results, err := compareRow(job.row)
+				job.out <- rowResults{results: results, err: err}
+			}
+		}()
+	}
+
+	for out := range pending {
+		row := <-out
+		if row.err != nil {
+			return row.err
+		}
+		for _, result := range row.results {
+			if err := f(result); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -1,16 +1,26 @@
 package sdhash
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 type testCase struct {
@@ -26,12 +36,12 @@ var testCases = []testCase{
 	{
 		name:        "zero-length",
 		length:      0,
-		expectedErr: "%s is too small",
+		expectedErr: "%s: input is too small",
 	},
 	{
 		name:        "small",
 		length:      256,
-		expectedErr: "%s is too small",
+		expectedErr: "%s: input is too small",
 	},
 	{
 		name:             "min-size",
@@ -67,22 +77,50 @@ func CreateSdbfTest(testName string, blockSize uint32, tmpDir string) func(t *te
 			if tc.onlyStreamMode && testName != "stream" {
 				continue
 			}
+			if testing.Short() && tc.length > mB {
+				continue
+			}
 
 			t.Run(tc.name, func(t1 *testing.T) {
 				factory, err := CreateSdbfFromFilename(tc.fileName)
 				var sd Sdbf
 				if tc.expectedErr != "" && err != nil {
 					assert.EqualError(t1, err, fmt.Sprintf(tc.expectedErr, tc.fileName))
+					assert.True(t1, errors.Is(err, ErrInputTooSmall))
 					return
 				} else if err == nil {
 					sdDigest, err := ioutil.ReadFile(fmt.Sprintf("testdata/%s/%s.sdbf", testName, tc.name))
 					require.NoError(t1, err)
 
-					sd = factory.WithBlockSize(blockSize * kB).WithName(tc.name).Compute()
+					sd, err = factory.WithBlockSize(blockSize * kB).WithName(tc.name).Compute()
+					require.NoError(t1, err)
 					// remove \r in windows builds
 					expected := strings.ReplaceAll(fmt.Sprintf(string(sdDigest), len(tc.name), tc.name), "\r", "")
 					assert.Equal(t1, expected, sd.String())
-					assert.Equal(t1, tc.compareSelfScore, sd.Compare(sd))
+					score, err := sd.Compare(sd)
+					require.NoError(t1, err)
+					assert.Equal(t1, tc.compareSelfScore, score)
+
+					file, err := os.Open(tc.fileName)
+					require.NoError(t1, err)
+					readerFactory, err := CreateSdbfFromReader(iotest.HalfReader(file))
+					require.NoError(t1, err)
+					sdFromReader, err := readerFactory.WithBlockSize(blockSize * kB).WithName(tc.name).Compute()
+					require.NoError(t1, err)
+					assert.Equal(t1, sd.String(), sdFromReader.String())
+					require.NoError(t1, file.Close())
+
+					file, err = os.Open(tc.fileName)
+					require.NoError(t1, err)
+					hasher := NewHasher().WithBlockSize(blockSize * kB).WithName(tc.name)
+					_, err = io.CopyBuffer(hasher, struct{ io.Reader }{file}, make([]uint8, 777))
+					require.NoError(t1, err)
+					sdFromHasher, err := hasher.Sum()
+					require.NoError(t1, err)
+					assert.Equal(t1, sd.String(), sdFromHasher.String())
+					_, err = hasher.Write([]uint8{0})
+					assert.Error(t1, err)
+					require.NoError(t1, file.Close())
 				} else {
 					require.Fail(t1, "invalid")
 					return
@@ -92,6 +130,29 @@ func CreateSdbfTest(testName string, blockSize uint32, tmpDir string) func(t *te
 				require.NoError(t1, err)
 				assert.Equal(t1, sd.String(), sdbfParsed.String())
 
+				data, err := sdbfParsed.MarshalBinary()
+				require.NoError(t1, err)
+				sdbfDecoded, err := ParseSdbfFromBytes(data)
+				require.NoError(t1, err)
+				assert.Equal(t1, sd.String(), sdbfDecoded.String())
+				score, err := sdbfDecoded.Compare(sd)
+				require.NoError(t1, err)
+				assert.Equal(t1, tc.compareSelfScore, score)
+
+				var binBuf bytes.Buffer
+				n, err := sd.WriteTo(&binBuf)
+				require.NoError(t1, err)
+				assert.Equal(t1, int64(len(data)), n)
+				assert.Equal(t1, data, binBuf.Bytes())
+				sdbfRead, err := ReadSdbf(&binBuf)
+				require.NoError(t1, err)
+				assert.Equal(t1, sd.String(), sdbfRead.String())
+
+				// the encoding of the index does not depend on the input, and decoding it is slow, so in short mode
+				// it is tested only once for each mode
+				if testing.Short() && tc.name != "medium" {
+					return
+				}
 				bf := sd.GetIndex().(*bloomFilter)
 				tmpFile := path.Join(tmpDir, fmt.Sprintf("%s-%s.idx", testName, tc.name))
 				require.NoError(t1, bf.WriteToFile(tmpFile))
@@ -142,3 +203,1192 @@ func TestSdbfSuite(t *testing.T) {
 
 	require.NoError(t, os.RemoveAll(tmpDir))
 }
+
+func TestFastCompare(t *testing.T) {
+	r := rand.New(rand.NewSource(mB))
+	buf := make([]uint8, mB)
+	_, err := r.Read(buf)
+	require.NoError(t, err)
+
+	// the folded filters are less accurate, so the fast scores drift from the normal ones, but at most by maxDrift,
+	// and they still decrease with the data in common
+	const maxDrift = 35
+	for _, blockSize := range []uint32{0, 16 * kB} {
+		prevScore, prevFastScore := 101, 101
+		for _, keep := range []int{100, 90, 50, 10} {
+			other := make([]uint8, len(buf))
+			copy(other, buf)
+			_, err := r.Read(other[:len(buf)*(100-keep)/100])
+			require.NoError(t, err)
+
+			factoryA, err := CreateSdbfFromBytes(buf)
+			require.NoError(t, err)
+			factoryB, err := CreateSdbfFromBytes(other)
+			require.NoError(t, err)
+			sdA, err := factoryA.WithBlockSize(blockSize).Compute()
+			require.NoError(t, err)
+			sdB, err := factoryB.WithBlockSize(blockSize).Compute()
+			require.NoError(t, err)
+
+			score, err := sdA.Compare(sdB)
+			require.NoError(t, err)
+			fastA, fastB := sdA.Folded(), sdB.Folded()
+			fastScore, err := fastA.Compare(fastB)
+			require.NoError(t, err)
+			unchangedScore, err := sdA.Compare(sdB)
+			require.NoError(t, err)
+			assert.Equal(t, score, unchangedScore)
+			drift := fastScore - score
+			t.Logf("block size %d, %d%% in common: score %d, fast score %d (drift %+d)", blockSize, keep,
+				score, fastScore, drift)
+			assert.True(t, drift >= -maxDrift && drift <= maxDrift, "block size %d, %d%% in common: drift %+d",
+				blockSize, keep, drift)
+			assert.True(t, score <= prevScore && fastScore <= prevFastScore,
+				"block size %d, %d%% in common: scores %d and %d are not decreasing", blockSize, keep, score, fastScore)
+			prevScore, prevFastScore = score, fastScore
+
+			if keep == 100 {
+				assert.Equal(t, 100, fastScore)
+			}
+			assert.True(t, fastScore >= 0 && fastScore <= 100)
+
+			_, err = sdA.Compare(fastB)
+			assert.True(t, errors.Is(err, ErrIncompatibleDigest))
+			_, err = fastA.Compare(sdB)
+			assert.True(t, errors.Is(err, ErrIncompatibleDigest))
+
+			parsedA, err := ParseSdbfFromString(fastA.String())
+			require.NoError(t, err)
+			assert.Equal(t, fastA.String(), parsedA.String())
+			parsedScore, err := parsedA.Compare(fastB)
+			require.NoError(t, err)
+			assert.Equal(t, fastScore, parsedScore)
+			_, err = parsedA.Compare(sdB)
+			assert.True(t, errors.Is(err, ErrIncompatibleDigest))
+
+			data, err := fastA.MarshalBinary()
+			require.NoError(t, err)
+			decodedA, err := ParseSdbfFromBytes(data)
+			require.NoError(t, err)
+			decodedScore, err := decodedA.Compare(fastB)
+			require.NoError(t, err)
+			assert.Equal(t, fastScore, decodedScore)
+			_, err = decodedA.Compare(sdB)
+			assert.True(t, errors.Is(err, ErrIncompatibleDigest))
+		}
+	}
+}
+
+func TestComputeContext(t *testing.T) {
+	r := rand.New(rand.NewSource(blockWindowSize))
+	size := blockWindowSize + kB
+	if testing.Short() {
+		// the input is not larger than a window, so the cancellation between windows is not tested
+		size = mB
+	}
+	buf := make([]uint8, size)
+	_, err := r.Read(buf)
+	require.NoError(t, err)
+	factory, err := CreateSdbfFromBytes(buf)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if size > blockWindowSize {
+		var calls int
+		sd, err := factory.WithBlockSize(16 * kB).WithProgress(func(bytes uint64, filters uint32) {
+			calls++
+			assert.Equal(t, uint64(blockWindowSize), bytes)
+			assert.Equal(t, uint32(blockWindowSize/(16*kB)), filters)
+			cancel()
+		}).ComputeContext(ctx)
+		assert.Equal(t, context.Canceled, err)
+		assert.Nil(t, sd)
+		assert.Equal(t, 1, calls)
+	}
+	cancel()
+
+	_, err = factory.ComputeContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	factory, err = CreateSdbfFromBytes(buf[:mB])
+	require.NoError(t, err)
+
+	var lastBytes uint64
+	var lastFilters uint32
+	sd, err := factory.WithProgress(func(bytes uint64, filters uint32) {
+		lastBytes, lastFilters = bytes, filters
+	}).ComputeContext(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, sd.InputSize(), lastBytes)
+	assert.Equal(t, sd.FilterCount(), lastFilters)
+}
+
+func TestHasherChunkBoundary(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the digest of a stream larger than a chunk in short mode")
+	}
+	buf := make([]uint8, streamChunkSize+100*kB+3)
+	_, err := rand.New(rand.NewSource(streamChunkSize)).Read(buf)
+	require.NoError(t, err)
+	factory, err := CreateSdbfFromBytes(buf)
+	require.NoError(t, err)
+	expected, err := factory.Compute()
+	require.NoError(t, err)
+	expectedData, err := expected.MarshalBinary()
+	require.NoError(t, err)
+
+	// the writes are uneven and the chunk boundary falls in the middle of one of them
+	hasher := NewHasher()
+	sizes := []int{1, 4093, 777 * kB, 3*mB + 11, 64*kB - 1}
+	for offset, i := 0, 0; offset < len(buf); i++ {
+		size := sizes[i%len(sizes)]
+		if offset+size > len(buf) {
+			size = len(buf) - offset
+		}
+		n, err := hasher.Write(buf[offset : offset+size])
+		require.NoError(t, err)
+		require.Equal(t, size, n)
+		offset += size
+	}
+	sd, err := hasher.Sum()
+	require.NoError(t, err)
+	data, err := sd.MarshalBinary()
+	require.NoError(t, err)
+	assert.Equal(t, expectedData, data)
+	assert.Equal(t, expected.String(), sd.String())
+}
+
+func TestErrors(t *testing.T) {
+	_, err := CreateSdbfFromBytes(make([]uint8, MinFileSize-1))
+	assert.True(t, errors.Is(err, ErrInputTooSmall))
+	_, err = CreateSdbfFromReader(bytes.NewReader(make([]uint8, MinFileSize-1)))
+	assert.True(t, errors.Is(err, ErrInputTooSmall))
+
+	hasher := NewHasher()
+	_, err = hasher.Write(make([]uint8, MinFileSize-1))
+	require.NoError(t, err)
+	_, err = hasher.Sum()
+	assert.Equal(t, ErrInputTooSmall, err)
+
+	factory, err := CreateSdbfFromBytes(make([]uint8, MinFileSize))
+	require.NoError(t, err)
+	sd, err := factory.Compute()
+	require.NoError(t, err)
+	_, err = sd.Compare(nil)
+	assert.Equal(t, ErrIncompatibleDigest, err)
+	_, err = sd.CompareSample(struct{ Sdbf }{sd}, 1)
+	assert.Equal(t, ErrIncompatibleDigest, err)
+
+	buf := make([]uint8, mB)
+	_, err = rand.New(rand.NewSource(mB)).Read(buf)
+	require.NoError(t, err)
+	factory, err = CreateSdbfFromReader(bytes.NewReader(buf))
+	require.NoError(t, err)
+	sd, err = factory.Compute()
+	require.NoError(t, err)
+	assert.True(t, sd.FilterCount() > 1)
+	_, err = factory.Compute()
+	assert.Equal(t, ErrSourceConsumed, err)
+}
+
+func TestParams(t *testing.T) {
+	buf := make([]uint8, mB)
+	_, err := rand.New(rand.NewSource(mB)).Read(buf)
+	require.NoError(t, err)
+
+	params := DefaultParams()
+	params.PopWinSize = 32
+	params.Threshold = 8
+	for _, blockSize := range []uint32{0, 4 * kB} {
+		factory, err := CreateSdbfFromBytes(buf)
+		require.NoError(t, err)
+		sdDefault, err := factory.WithBlockSize(blockSize).Compute()
+		require.NoError(t, err)
+		sdCustom, err := factory.WithParams(params).Compute()
+		require.NoError(t, err)
+		assert.NotEqual(t, sdDefault.String(), sdCustom.String())
+
+		sdParsed, err := ParseSdbfFromString(sdCustom.String())
+		require.NoError(t, err)
+		assert.Equal(t, sdCustom.String(), sdParsed.String())
+		score, err := sdParsed.Compare(sdCustom)
+		require.NoError(t, err)
+		assert.Equal(t, 100, score)
+
+		_, err = sdDefault.Compare(sdCustom)
+		assert.True(t, errors.Is(err, ErrIncompatibleDigest))
+	}
+
+	params.EntropyWinSize = 32
+	factory, err := CreateSdbfFromBytes(buf)
+	require.NoError(t, err)
+	_, err = factory.WithParams(params).Compute()
+	assert.True(t, errors.Is(err, ErrInvalidParams))
+
+	// the params in the header of a digest are validated like the ones of the binary encoding
+	factory, err = CreateSdbfFromBytes(buf)
+	require.NoError(t, err)
+	sdStream, err := factory.Compute()
+	require.NoError(t, err)
+	sdBlock, err := factory.WithBlockSize(4 * kB).Compute()
+	require.NoError(t, err)
+	for _, digest := range []string{
+		strings.Replace(sdStream.String(), ":sha1:256:", ":sha1:0:", 1),
+		strings.Replace(sdStream.String(), ":sha1:256:", ":sha1:128:", 1),
+		strings.Replace(sdStream.String(), ":03:", ":04:0,0,0,0:", 1),
+		strings.Replace(sdStream.String(), ":03:", ":04:64,16,4096,32:", 1),
+		strings.Replace(sdBlock.String(), ":7ff:192:", ":7ff:0:", 1),
+	} {
+		_, err = ParseSdbfFromString(digest)
+		assert.True(t, errors.Is(err, ErrInvalidParams), digest[:64])
+	}
+	_, err = ParseSdbfFromString(strings.Replace(sdBlock.String(), ":sha1:256:", ":sha1:4294967552:", 1))
+	assert.EqualError(t, err, "failed to parse bloom filter size")
+
+	// the elements count of each filter can't exceed the max elements count, which is bounded
+	_, err = ParseSdbfFromString(strings.Replace(sdStream.String(), ":7ff:160:", ":7ff:2147483647:", 1))
+	assert.True(t, errors.Is(err, ErrInvalidParams))
+	fields := strings.Split(sdStream.String(), ":")
+	fields[9], fields[11] = "160", "2147483647"
+	_, err = ParseSdbfFromString(strings.Join(fields, ":"))
+	assert.EqualError(t, err, "invalid last count")
+	_, err = ParseSdbfFromString(strings.Replace(sdBlock.String(), ":7ff:192:", ":7ff:40:", 1))
+	assert.EqualError(t, err, "invalid dd elem")
+	fields[9], fields[11] = "65535", "65535"
+	sdCrafted, err := ParseSdbfFromString(strings.Join(fields, ":"))
+	require.NoError(t, err)
+	for _, sd := range []Sdbf{sdStream, sdBlock, sdCrafted} {
+		_, err = sdCrafted.Compare(sd)
+		assert.NoError(t, err)
+		_, err = sd.Compare(sdCrafted)
+		assert.NoError(t, err)
+	}
+}
+
+func TestBinaryEncoding(t *testing.T) {
+	buf := make([]uint8, mB)
+	_, err := rand.New(rand.NewSource(mB)).Read(buf)
+	require.NoError(t, err)
+
+	var stream bytes.Buffer
+	var digests []Sdbf
+	for _, blockSize := range []uint32{0, 4 * kB} {
+		factory, err := CreateSdbfFromBytes(buf)
+		require.NoError(t, err)
+		sd, err := factory.WithBlockSize(blockSize).WithName(fmt.Sprintf("block-%d", blockSize)).Compute()
+		require.NoError(t, err)
+		_, err = sd.WriteTo(&stream)
+		require.NoError(t, err)
+		digests = append(digests, sd)
+	}
+	for _, sd := range digests {
+		sdRead, err := ReadSdbf(&stream)
+		require.NoError(t, err)
+		assert.Equal(t, sd.String(), sdRead.String())
+	}
+	_, err = ReadSdbf(&stream)
+	assert.Equal(t, io.EOF, err)
+
+	// decoding into an existing Sdbf replaces it
+	data, err := digests[1].MarshalBinary()
+	require.NoError(t, err)
+	replaced := digests[0].Folded()
+	require.NoError(t, replaced.UnmarshalBinary(data))
+	assert.Equal(t, digests[1].String(), replaced.String())
+	replaced = digests[1].Folded()
+	n, err := replaced.ReadFrom(io.MultiReader(bytes.NewReader(data), bytes.NewReader(data)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), n)
+	assert.Equal(t, digests[1].String(), replaced.String())
+	assert.Error(t, replaced.UnmarshalBinary(data[1:]))
+	assert.Equal(t, digests[1].String(), replaced.String())
+
+	data, err = digests[0].MarshalBinary()
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xff
+	_, err = ParseSdbfFromBytes(data)
+	assert.EqualError(t, err, "checksum mismatch")
+	_, err = ParseSdbfFromBytes(data[:len(data)-1])
+	assert.Error(t, err)
+	_, err = ReadSdbf(bytes.NewReader(data[:len(data)-1]))
+	assert.Error(t, err)
+
+	// crafted encodings, with valid length and checksum
+	seal := func(data []uint8) []uint8 {
+		binary.LittleEndian.PutUint64(data[len(binaryMagic)+1:], uint64(len(data)-binaryHeaderSize-binaryChecksumSize))
+		checksumPos := len(data) - binaryChecksumSize
+		binary.LittleEndian.PutUint32(data[checksumPos:], crc32.ChecksumIEEE(data[:checksumPos]))
+		return data
+	}
+	data, err = digests[0].MarshalBinary()
+	require.NoError(t, err)
+	paramsPos := binaryHeaderSize + 1
+	countsPos := paramsPos + 7*4 + 4 + len(digests[0].Name()) + 8
+	for _, version := range []uint8{0, binaryVersion + 1} {
+		crafted := append([]uint8{}, data...)
+		crafted[len(binaryMagic)] = version
+		_, err = ParseSdbfFromBytes(seal(crafted))
+		assert.EqualError(t, err, "invalid binary version")
+	}
+	crafted := append([]uint8{}, data...)
+	binary.LittleEndian.PutUint32(crafted[paramsPos:], 128)
+	_, err = ParseSdbfFromBytes(seal(crafted))
+	assert.True(t, errors.Is(err, ErrInvalidParams))
+	crafted = append([]uint8{}, data...)
+	binary.LittleEndian.PutUint32(crafted[paramsPos+4*4:], 0)
+	_, err = ParseSdbfFromBytes(seal(crafted))
+	assert.True(t, errors.Is(err, ErrInvalidParams))
+	crafted = append(append([]uint8{}, data[:countsPos+8]...), 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(crafted[countsPos:], 0)
+	_, err = ParseSdbfFromBytes(seal(crafted))
+	assert.EqualError(t, err, "invalid bloom filter count")
+	crafted = append([]uint8{}, data...)
+	binary.LittleEndian.PutUint32(crafted[countsPos+4:], 2147483647)
+	_, err = ParseSdbfFromBytes(seal(crafted))
+	assert.EqualError(t, err, "invalid last elements count")
+}
+
+func TestReaderWriter(t *testing.T) {
+	buf := make([]uint8, 4*mB)
+	_, err := rand.New(rand.NewSource(4 * mB)).Read(buf)
+	require.NoError(t, err)
+
+	var sb strings.Builder
+	w := NewWriter(&sb)
+	var digests []Sdbf
+	for _, blockSize := range []uint32{0, 4 * kB} {
+		factory, err := CreateSdbfFromBytes(buf)
+		require.NoError(t, err)
+		sd, err := factory.WithBlockSize(blockSize).WithName(fmt.Sprintf("block-%d", blockSize)).Compute()
+		require.NoError(t, err)
+		require.NoError(t, w.Write(sd))
+		digests = append(digests, sd)
+	}
+	require.NoError(t, w.Flush())
+	require.Greater(t, len(sb.String()), 64*kB) // larger than the default bufio.Scanner token size
+
+	// empty lines are skipped and the last line can be without newline
+	text := "\n" + strings.TrimSuffix(strings.Replace(sb.String(), "\n", "\n\r\n", 1), "\n")
+	r := NewReader(strings.NewReader(text))
+	sdbfs, err := r.ReadAll()
+	require.NoError(t, err)
+	require.Len(t, sdbfs, len(digests))
+	for i, sd := range digests {
+		assert.Equal(t, sd.String(), sdbfs[i].String())
+	}
+	assert.Equal(t, 4, r.Line())
+
+	r = NewReader(strings.NewReader(sb.String() + "sdbf:invalid\n"))
+	_, err = r.ReadAll()
+	assert.EqualError(t, err, "line 3: failed to read version")
+
+	// truncated and corrupted digests
+	lines := strings.Split(sb.String(), "\n")
+	streamLine, ddLine := lines[0], lines[1]
+	lastChunk := strings.LastIndexByte(ddLine, ':')
+	for line, expected := range map[string]string{
+		"sdbf:03:1:a:100:sha1:256:5:7ff:160:10:0:AAAA": "invalid bloom filter count",
+		streamLine[:len(streamLine)-8]:                 "invalid bloom filters buffer length",
+		ddLine[:lastChunk+1] + "AAAA":                  "invalid dd buffer length",
+		ddLine[:len(ddLine)-8]:                         "invalid dd buffer length",
+	} {
+		r = NewReader(strings.NewReader(sb.String() + line + "\n"))
+		_, err = r.ReadAll()
+		assert.EqualError(t, err, "line 3: "+expected)
+	}
+}
+
+func TestSet(t *testing.T) {
+	buf := make([]uint8, mB)
+	_, err := rand.New(rand.NewSource(mB)).Read(buf)
+	require.NoError(t, err)
+
+	s := NewSet(nil)
+	var wg sync.WaitGroup
+	for i, name := range []string{"a", "b", "a", "c"} {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			factory, err := CreateSdbfFromBytes(buf[i*kB : i*kB+mB/2])
+			require.NoError(t, err)
+			sd, err := factory.WithName(name).Compute()
+			require.NoError(t, err)
+			s.Add(sd)
+		}(i, name)
+	}
+	wg.Wait()
+	assert.Equal(t, 4, s.Len())
+	assert.Nil(t, s.Index())
+
+	sd, ok := s.Lookup("b")
+	require.True(t, ok)
+	assert.Equal(t, "b", sd.Name())
+	_, ok = s.Lookup("d")
+	assert.False(t, ok)
+
+	var results []Result
+	require.NoError(t, s.CompareAll(0, CollectResults(&results)))
+	assert.Len(t, results, 6)
+	for _, result := range results {
+		assert.NotEqual(t, result.Query, result.Target)
+		assert.True(t, result.Score > 0)
+	}
+	results = nil
+	require.NoError(t, s.CompareAll(101, CollectResults(&results)))
+	assert.Empty(t, results)
+
+	errStop := errors.New("stop")
+	var calls int
+	assert.Equal(t, errStop, s.CompareAll(0, func(result Result) error {
+		calls++
+		return errStop
+	}))
+	assert.Equal(t, 1, calls)
+
+	assert.Equal(t, 2, s.Remove("a"))
+	assert.Equal(t, 0, s.Remove("a"))
+	var names []string
+	s.Range(func(sd Sdbf) bool {
+		names = append(names, sd.Name())
+		return true
+	})
+	assert.ElementsMatch(t, []string{"b", "c"}, names)
+
+	other := NewSet(NewBloomFilter())
+	other.Add(s.Items()[0])
+	assert.NotNil(t, other.Index())
+	ch := make(chan Result)
+	go func() {
+		assert.NoError(t, s.CompareTo(other, 0, 0, DefaultSeed, SendResults(context.Background(), ch)))
+		close(ch)
+	}()
+	results = nil
+	for result := range ch {
+		results = append(results, result)
+	}
+	assert.Len(t, results, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, s.CompareTo(other, 0, 0, DefaultSeed, SendResults(ctx, make(chan Result))))
+	assert.Equal(t, s.String(), s.Items()[0].String()+s.Items()[1].String())
+}
+
+// newRandomSet creates a Set of n digests with a single random filter each, to test comparisons on large sets
+// without digesting data.
+func newRandomSet(n int, seed int64) Set {
+	return newRandomFiltersSet(n, 1, seed)
+}
+
+// newRandomFiltersSet creates a Set of n digests with the specified number of random filters each.
+func newRandomFiltersSet(n int, filters uint32, seed int64) Set {
+	r := rand.New(rand.NewSource(seed))
+	params := DefaultParams()
+	s := NewSet(nil)
+	for i := 0; i < n; i++ {
+		sd := &sdbf{
+			hashName:  fmt.Sprintf("%d-%d", seed, i),
+			params:    params,
+			bfSize:    params.BfSize,
+			bfCount:   filters,
+			lastCount: params.MaxElem,
+			maxElem:   params.MaxElem,
+			buffer:    make([]uint8, filters*params.BfSize),
+		}
+		for k := uint32(0); k < filters*params.MaxElem*5; k++ {
+			bit := r.Intn(len(sd.buffer) * 8)
+			sd.buffer[bit/8] |= 1 << (bit % 8)
+		}
+		sd.computeHamming()
+		s.Add(sd)
+	}
+	return s
+}
+
+func TestParallelCompareOrder(t *testing.T) {
+	queries, targets := newRandomSet(300, 1), newRandomSet(200, 2)
+	qItems, tItems := queries.Items(), targets.Items()
+
+	var expected []Result
+	for i := range qItems {
+		for j := i + 1; j < len(qItems); j++ {
+			score, err := qItems[i].Compare(qItems[j])
+			require.NoError(t, err)
+			expected = append(expected, Result{Query: qItems[i], Target: qItems[j], Score: score})
+		}
+	}
+	var results []Result
+	require.NoError(t, queries.CompareAll(0, CollectResults(&results)))
+	assert.Equal(t, expected, results)
+
+	expected = nil
+	for _, query := range qItems {
+		for _, target := range tItems {
+			score, err := query.Compare(target)
+			require.NoError(t, err)
+			expected = append(expected, Result{Query: query, Target: target, Score: score})
+		}
+	}
+	results = nil
+	require.NoError(t, queries.CompareTo(targets, 0, 0, DefaultSeed, CollectResults(&results)))
+	assert.Equal(t, expected, results)
+
+	errStop := errors.New("stop")
+	assert.Equal(t, errStop, queries.CompareTo(targets, 0, 0, DefaultSeed, func(result Result) error {
+		return errStop
+	}))
+	invalid := NewSet(nil)
+	invalid.Add(struct{ Sdbf }{tItems[0]})
+	assert.Equal(t, ErrIncompatibleDigest, queries.CompareTo(invalid, 0, 0, DefaultSeed, CollectResults(&results)))
+}
+
+// BenchmarkSetCompareTo measures set-vs-set comparisons. Run it with different -cpu values to measure how the
+// comparison engine scales, for example: go test -run - -bench SetCompareTo -cpu 1,2,4,8
+func BenchmarkSetCompareTo(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		queries, targets := newRandomSet(n, 1), newRandomSet(n, 2)
+		b.Run(fmt.Sprintf("%dx%d", n, n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, queries.CompareTo(targets, 1, 0, DefaultSeed, func(result Result) error {
+					return nil
+				}))
+			}
+		})
+	}
+}
+
+// BenchmarkSetCompareAll measures all-pairs comparisons in a set.
+func BenchmarkSetCompareAll(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000} {
+		s := newRandomSet(n, 1)
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, s.CompareAll(1, func(result Result) error {
+					return nil
+				}))
+			}
+		})
+	}
+}
+
+// BenchmarkCompareRows measures the throughput of the comparison engine against a serial comparison of the same
+// pairs, varying the size of the sets and the filters of each digest. The throughput is reported in comparisons
+// per second, so that the speedup of compareRows is the ratio between the parallel and the serial throughput.
+func BenchmarkCompareRows(b *testing.B) {
+	for _, bc := range []struct {
+		n       int
+		filters uint32
+	}{{100, 1}, {1000, 1}, {100, 8}, {100, 32}} {
+		queries, targets := newRandomFiltersSet(bc.n, bc.filters, 1), newRandomFiltersSet(bc.n, bc.filters, 2)
+		qItems, tItems := queries.Items(), targets.Items()
+		comparisons := float64(len(qItems) * len(tItems))
+
+		b.Run(fmt.Sprintf("%dx%d-filters-%d/serial", bc.n, bc.n, bc.filters), func(b *testing.B) {
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				for _, query := range qItems {
+					for _, target := range tItems {
+						_, err := compareThreshold(query, target, 1, 0, DefaultSeed)
+						require.NoError(b, err)
+					}
+				}
+			}
+			b.ReportMetric(comparisons*float64(b.N)/time.Since(start).Seconds(), "cmp/s")
+		})
+		b.Run(fmt.Sprintf("%dx%d-filters-%d/parallel", bc.n, bc.n, bc.filters), func(b *testing.B) {
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, queries.CompareTo(targets, 1, 0, DefaultSeed, func(result Result) error {
+					return nil
+				}))
+			}
+			b.ReportMetric(comparisons*float64(b.N)/time.Since(start).Seconds(), "cmp/s")
+		})
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	buf := make([]uint8, mB+kB/2)
+	_, err := rand.New(rand.NewSource(4 * mB)).Read(buf)
+	require.NoError(t, err)
+
+	factory, err := CreateSdbfFromBytes(buf)
+	require.NoError(t, err)
+	expected, err := factory.WithBlockSize(kB).Compute()
+	require.NoError(t, err)
+	for _, concurrency := range []int{1, 3, 16} {
+		sd, err := factory.WithConcurrency(concurrency).Compute()
+		require.NoError(t, err)
+		assert.Equal(t, expected.String(), sd.String())
+
+		hasher := NewHasher().WithBlockSize(kB).WithConcurrency(concurrency)
+		_, err = hasher.Write(buf)
+		require.NoError(t, err)
+		sd, err = hasher.Sum()
+		require.NoError(t, err)
+		assert.Equal(t, expected.String(), sd.String())
+	}
+}
+
+func TestCompareSampleSeed(t *testing.T) {
+	r := rand.New(rand.NewSource(4 * mB))
+	buf := make([]uint8, 4*mB)
+	_, err := r.Read(buf)
+	require.NoError(t, err)
+	other := make([]uint8, 2*mB)
+	copy(other, buf[:mB])
+	_, err = r.Read(other[mB:])
+	require.NoError(t, err)
+
+	factory, err := CreateSdbfFromBytes(buf)
+	require.NoError(t, err)
+	sdA, err := factory.Compute()
+	require.NoError(t, err)
+	factory, err = CreateSdbfFromBytes(other)
+	require.NoError(t, err)
+	sdB, err := factory.Compute()
+	require.NoError(t, err)
+
+	score, err := sdB.Compare(sdA)
+	require.NoError(t, err)
+	sample := sdB.FilterCount() / 4
+	for seed := int64(0); seed < 8; seed++ {
+		sampledScore, err := sdB.CompareSampleSeed(sdA, sample, seed)
+		require.NoError(t, err)
+		// the sampled filters are spread across the whole digest, so the score is close to the full score
+		assert.InDelta(t, score, sampledScore, 10, "seed %d", seed)
+		for _, sd := range []Sdbf{sdA, sdB} {
+			expected, err := sd.CompareSampleSeed(sdB, sample, seed)
+			require.NoError(t, err)
+			sampledScore, err := sd.CompareSampleSeed(sdB, sample, seed)
+			require.NoError(t, err)
+			assert.Equal(t, expected, sampledScore)
+		}
+	}
+	sampledScore, err := sdA.CompareSample(sdB, sample)
+	require.NoError(t, err)
+	expected, err := sdA.CompareSampleSeed(sdB, sample, DefaultSeed)
+	require.NoError(t, err)
+	assert.Equal(t, expected, sampledScore)
+}
+
+func TestCompareDetailed(t *testing.T) {
+	r := rand.New(rand.NewSource(256 * kB))
+	bufA := make([]uint8, 256*kB)
+	_, err := r.Read(bufA)
+	require.NoError(t, err)
+	bufB := make([]uint8, 512*kB)
+	_, err = r.Read(bufB)
+	require.NoError(t, err)
+	copy(bufB[128*kB:], bufA[64*kB:192*kB])
+
+	factory, err := CreateSdbfFromBytes(bufA)
+	require.NoError(t, err)
+	sdA, err := factory.WithBlockSize(4 * kB).Compute()
+	require.NoError(t, err)
+	factory, err = CreateSdbfFromBytes(bufB)
+	require.NoError(t, err)
+	sdB, err := factory.WithBlockSize(4 * kB).Compute()
+	require.NoError(t, err)
+
+	for _, pair := range [][]Sdbf{{sdA, sdB}, {sdB, sdA}} {
+		score, regions, err := pair[0].CompareDetailed(pair[1])
+		require.NoError(t, err)
+		expected, err := pair[0].Compare(pair[1])
+		require.NoError(t, err)
+		assert.Equal(t, expected, score)
+
+		var matched int
+		for _, region := range regions {
+			assert.Equal(t, int64(4*kB), region.LengthA)
+			assert.Equal(t, int64(4*kB), region.LengthB)
+			offsetA, offsetB := region.OffsetA, region.OffsetB
+			if pair[0] == sdB {
+				offsetA, offsetB = offsetB, offsetA
+			}
+			if region.Score == 100 {
+				matched++
+				assert.Equal(t, offsetA+64*kB, offsetB)
+				assert.True(t, offsetA >= 64*kB && offsetA < 192*kB)
+			}
+		}
+		assert.True(t, matched > 16)
+	}
+
+	factory, err = CreateSdbfFromBytes(bufA)
+	require.NoError(t, err)
+	sdStream, err := factory.Compute()
+	require.NoError(t, err)
+	_, regions, err := sdStream.CompareDetailed(sdStream)
+	require.NoError(t, err)
+	require.NotEmpty(t, regions)
+	assert.Equal(t, Region{FilterA: 0, FilterB: 0, OffsetA: -1, LengthA: -1, OffsetB: -1, LengthB: -1, Score: 100},
+		regions[0])
+}
+
+func TestContainment(t *testing.T) {
+	r := rand.New(rand.NewSource(mB))
+	container := make([]uint8, mB)
+	_, err := r.Read(container)
+	require.NoError(t, err)
+	embedded := make([]uint8, 128*kB)
+	_, err = r.Read(embedded)
+	require.NoError(t, err)
+	copy(container[256*kB:], embedded)
+
+	for _, blockSize := range []uint32{0, 4 * kB} {
+		factory, err := CreateSdbfFromBytes(embedded)
+		require.NoError(t, err)
+		sdEmbedded, err := factory.WithBlockSize(blockSize).Compute()
+		require.NoError(t, err)
+		factory, err = CreateSdbfFromBytes(container)
+		require.NoError(t, err)
+		sdContainer, err := factory.WithBlockSize(blockSize).Compute()
+		require.NoError(t, err)
+
+		aInB, bInA, err := sdEmbedded.Containment(sdContainer)
+		require.NoError(t, err)
+		assert.True(t, aInB >= 50, "block size %d: %d", blockSize, aInB)
+		assert.True(t, bInA <= 25, "block size %d: %d", blockSize, bInA)
+
+		reversedAInB, reversedBInA, err := sdContainer.Containment(sdEmbedded)
+		require.NoError(t, err)
+		assert.Equal(t, aInB, reversedBInA)
+		assert.Equal(t, bInA, reversedAInB)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	buf := make([]uint8, 2*mB)
+	_, err := rand.New(rand.NewSource(2 * mB)).Read(buf)
+	require.NoError(t, err)
+
+	corpus := newRandomSet(200, 3)
+	for i := 0; i < 8; i++ {
+		factory, err := CreateSdbfFromBytes(buf[i*64*kB : i*64*kB+mB])
+		require.NoError(t, err)
+		sd, err := factory.WithBlockSize(16 * kB).WithName(fmt.Sprintf("block-%d", i)).Compute()
+		require.NoError(t, err)
+		corpus.Add(sd)
+	}
+	factory, err := CreateSdbfFromBytes(buf[mB/2 : mB+mB/2])
+	require.NoError(t, err)
+	query, err := factory.WithBlockSize(16 * kB).Compute()
+	require.NoError(t, err)
+
+	var expected []Result
+	for _, item := range corpus.Items() {
+		score, err := query.Compare(item)
+		require.NoError(t, err)
+		bound, err := query.CompareThreshold(item, 101)
+		require.NoError(t, err)
+		assert.True(t, bound >= score, "upper bound %d lower than score %d", bound, score)
+		if score > 0 {
+			expected = append(expected, Result{Query: query, Target: item, Score: score})
+		}
+	}
+	sort.SliceStable(expected, func(i, j int) bool {
+		return expected[i].Score > expected[j].Score
+	})
+	require.True(t, len(expected) > 5)
+
+	for _, k := range []int{0, 1, 5, len(expected) + 10, int(^uint(0) >> 1)} {
+		results, err := corpus.Query(query, k)
+		require.NoError(t, err)
+		if k == 0 {
+			assert.Empty(t, results)
+		} else if k < len(expected) {
+			assert.Equal(t, expected[:k], results, "k %d", k)
+		} else {
+			assert.Equal(t, expected, results, "k %d", k)
+		}
+	}
+}
+
+func TestCompareThreshold(t *testing.T) {
+	buf := make([]uint8, mB)
+	_, err := rand.New(rand.NewSource(2 * mB)).Read(buf)
+	require.NoError(t, err)
+
+	sdbfs := newRandomSet(20, 4).Items()
+	for i := 0; i < 6; i++ {
+		for _, blockSize := range []uint32{0, 16 * kB} {
+			factory, err := CreateSdbfFromBytes(buf[i*64*kB : i*64*kB+mB/2])
+			require.NoError(t, err)
+			sd, err := factory.WithBlockSize(blockSize).WithName(fmt.Sprintf("%d-%d", blockSize, i)).Compute()
+			require.NoError(t, err)
+			sdbfs = append(sdbfs, sd)
+		}
+	}
+
+	for i, sd1 := range sdbfs {
+		for _, sd2 := range sdbfs[i:] {
+			score, err := sd1.Compare(sd2)
+			require.NoError(t, err)
+			for _, threshold := range []int{0, 1, 10, 25, 50, 75, 100} {
+				thresholdScore, err := sd1.CompareThreshold(sd2, threshold)
+				require.NoError(t, err)
+				if score >= threshold {
+					assert.Equal(t, score, thresholdScore, "%s %s %d", sd1.Name(), sd2.Name(), threshold)
+				} else {
+					assert.True(t, thresholdScore < threshold && thresholdScore >= score, "%s %s %d: %d, %d",
+						sd1.Name(), sd2.Name(), threshold, thresholdScore, score)
+				}
+				matches, err := sd1.Matches(sd2, threshold)
+				require.NoError(t, err)
+				assert.Equal(t, score >= threshold, matches, "%s %s %d", sd1.Name(), sd2.Name(), threshold)
+			}
+		}
+	}
+
+	_, err = sdbfs[0].CompareThreshold(struct{ Sdbf }{sdbfs[1]}, 1)
+	assert.Equal(t, ErrIncompatibleDigest, err)
+}
+
+// BenchmarkCompareThreshold measures how much of a comparison is skipped by CompareThreshold, comparing a digest to
+// unrelated digests with a full comparison and with increasing thresholds. The difference between the time of the
+// full comparison and the time of each threshold is the work skipped using the score bounds.
+func BenchmarkCompareThreshold(b *testing.B) {
+	r := rand.New(rand.NewSource(mB))
+	var sdbfs []Sdbf
+	for i := 0; i < 9; i++ {
+		buf := make([]uint8, mB)
+		_, err := r.Read(buf)
+		require.NoError(b, err)
+		factory, err := CreateSdbfFromBytes(buf)
+		require.NoError(b, err)
+		sd, err := factory.WithBlockSize(16 * kB).Compute()
+		require.NoError(b, err)
+		sdbfs = append(sdbfs, sd)
+	}
+	query, targets := sdbfs[0], sdbfs[1:]
+
+	b.Run("full", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, target := range targets {
+				_, err := query.Compare(target)
+				require.NoError(b, err)
+			}
+		}
+	})
+	for _, threshold := range []int{10, 25, 50, 75} {
+		b.Run(fmt.Sprintf("threshold-%d", threshold), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, target := range targets {
+					_, err := query.CompareThreshold(target, threshold)
+					require.NoError(b, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompareThresholdSparseTarget(t *testing.T) {
+	params := DefaultParams()
+	newDigest := func(name string, elemCounts []uint16) *sdbf {
+		sd := &sdbf{
+			hashName:    name,
+			params:      params,
+			bfSize:      params.BfSize,
+			bfCount:     uint32(len(elemCounts)),
+			maxElem:     params.MaxElemDd,
+			elemCounts:  elemCounts,
+			ddBlockSize: 16 * kB,
+			buffer:      make([]uint8, uint32(len(elemCounts))*params.BfSize),
+		}
+		r := rand.New(rand.NewSource(int64(len(name))))
+		for i, count := range elemCounts {
+			for k := uint16(0); k < count*5; k++ {
+				bit := uint32(r.Intn(int(params.BfSize) * 8))
+				sd.buffer[uint32(i)*params.BfSize+bit/8] |= 1 << (bit % 8)
+			}
+		}
+		sd.computeHamming()
+		return sd
+	}
+	// the dense filter of the reference has no comparable filter in the target
+	ref, target := newDigest("reference", []uint16{100, 5}), newDigest("target", []uint16{5, 5})
+
+	score, err := ref.Compare(target)
+	require.NoError(t, err)
+	for _, threshold := range []int{-1, 0, 1} {
+		thresholdScore, err := ref.CompareThreshold(target, threshold)
+		require.NoError(t, err)
+		if score >= threshold {
+			assert.Equal(t, score, thresholdScore, "threshold %d", threshold)
+		}
+		matches, err := ref.Matches(target, threshold)
+		require.NoError(t, err)
+		assert.Equal(t, score >= threshold, matches, "threshold %d", threshold)
+	}
+
+	var results []Result
+	s := NewSet(nil)
+	s.Add(ref, target)
+	require.NoError(t, s.CompareAll(score, CollectResults(&results)))
+	require.Len(t, results, 1)
+	assert.Equal(t, score, results[0].Score)
+}
+
+func TestConcurrentCompare(t *testing.T) {
+	buf := make([]uint8, mB)
+	_, err := rand.New(rand.NewSource(mB)).Read(buf)
+	require.NoError(t, err)
+	factory, err := CreateSdbfFromBytes(buf)
+	require.NoError(t, err)
+	computed, err := factory.WithBlockSize(16 * kB).Compute()
+	require.NoError(t, err)
+	reference, err := ParseSdbfFromString(computed.String())
+	require.NoError(t, err)
+
+	others := newRandomSet(8, 5).Items()
+	for i := 0; i < 4; i++ {
+		factory, err := CreateSdbfFromBytes(buf[i*128*kB : i*128*kB+512*kB])
+		require.NoError(t, err)
+		sd, err := factory.WithBlockSize(16 * kB).Compute()
+		require.NoError(t, err)
+		others = append(others, sd)
+	}
+
+	compare := func(sd Sdbf, other Sdbf) []int {
+		score, err := sd.Compare(other)
+		assert.NoError(t, err)
+		detailedScore, _, err := sd.CompareDetailed(other)
+		assert.NoError(t, err)
+		aInB, bInA, err := sd.Containment(other)
+		assert.NoError(t, err)
+		thresholdScore, err := sd.CompareThreshold(other, 50)
+		assert.NoError(t, err)
+		fastScore, err := sd.Folded().Compare(other.Folded())
+		assert.NoError(t, err)
+		return []int{score, detailedScore, aInB, bInA, thresholdScore, fastScore}
+	}
+	expected := make([][]int, len(others))
+	for i, other := range others {
+		expected[i] = compare(reference, other)
+	}
+
+	var wg sync.WaitGroup
+	results := make([][][]int, 8)
+	for g := range results {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for _, other := range others {
+				results[g] = append(results[g], compare(reference, other))
+			}
+		}(g)
+	}
+	wg.Wait()
+	for _, result := range results {
+		assert.Equal(t, expected, result)
+	}
+	assert.Equal(t, computed.String(), reference.String())
+}
+
+func TestBloomFilterMerge(t *testing.T) {
+	bf1, bf2 := NewBloomFilter(), NewBloomFilter()
+	sha1A, sha1B := [5]uint32{1, 2, 3, 4, 5}, [5]uint32{6, 7, 8, 9, 10}
+	require.True(t, bf1.insertSha1(sha1A[:]))
+	require.True(t, bf2.insertSha1(sha1B[:]))
+
+	require.NoError(t, bf1.Merge(bf2))
+	assert.True(t, bf1.querySha1(sha1A[:]))
+	assert.True(t, bf1.querySha1(sha1B[:]))
+	assert.False(t, bf2.querySha1(sha1A[:]))
+	assert.Equal(t, uint64(2), bf1.ElemCount())
+
+	small, err := newBloomFilter(kB, 5, 0)
+	require.NoError(t, err)
+	assert.Equal(t, ErrIncompatibleBloomFilter, bf1.Merge(small))
+}
+
+func TestLSHIndex(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the digest of a large corpus in short mode")
+	}
+	buf := make([]uint8, 4*mB)
+	_, err := rand.New(rand.NewSource(4 * mB)).Read(buf)
+	require.NoError(t, err)
+
+	corpus := newRandomSet(200, 6)
+	for i := 0; i < 20; i++ {
+		factory, err := CreateSdbfFromBytes(buf[i*128*kB : i*128*kB+mB])
+		require.NoError(t, err)
+		sd, err := factory.WithBlockSize(uint32(i%2) * 16 * kB).WithName(fmt.Sprintf("data-%d", i)).Compute()
+		require.NoError(t, err)
+		corpus.Add(sd)
+	}
+	var queries []Sdbf
+	for _, blockSize := range []uint32{0, 16 * kB} {
+		factory, err := CreateSdbfFromBytes(buf[mB/2+7*kB : 2*mB+mB/2])
+		require.NoError(t, err)
+		query, err := factory.WithBlockSize(blockSize).Compute()
+		require.NoError(t, err)
+		queries = append(queries, query)
+	}
+
+	index, err := NewLSHIndex(DefaultLSHParams())
+	require.NoError(t, err)
+	require.NoError(t, index.Add(corpus.Items()...))
+	assert.Equal(t, corpus.Len(), index.Len())
+
+	recall, err := index.Recall(queries, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, recall)
+	for _, query := range queries {
+		candidates, err := index.Candidates(query)
+		require.NoError(t, err)
+		assert.True(t, len(candidates) < corpus.Len()/4, "%d candidates", len(candidates))
+
+		expected, err := corpus.Query(query, 5)
+		require.NoError(t, err)
+		results, err := index.Query(query, 5)
+		require.NoError(t, err)
+		assert.Equal(t, expected, results)
+	}
+
+	narrow, err := NewLSHIndex(LSHParams{Bands: 2, Rows: 16, Seed: DefaultSeed})
+	require.NoError(t, err)
+	require.NoError(t, narrow.Add(corpus.Items()...))
+	narrowRecall, err := narrow.Recall(queries, 10)
+	require.NoError(t, err)
+	assert.True(t, narrowRecall < recall, "recall %f", narrowRecall)
+
+	_, err = NewLSHIndex(LSHParams{Bands: 0, Rows: 8})
+	assert.True(t, errors.Is(err, ErrInvalidParams))
+	assert.Equal(t, ErrIncompatibleDigest, index.Add(struct{ Sdbf }{queries[0]}))
+	_, err = index.Candidates(struct{ Sdbf }{queries[0]})
+	assert.Equal(t, ErrIncompatibleDigest, err)
+}
+
+func TestMultiIndex(t *testing.T) {
+	r := rand.New(rand.NewSource(7))
+	randomSha1 := func() []uint32 {
+		sha1 := make([]uint32, 5)
+		for i := range sha1 {
+			sha1[i] = r.Uint32()
+		}
+		return sha1
+	}
+	var features [][]uint32
+	indexes := make([]BloomFilter, 70)
+	for i := range indexes {
+		bf, err := newBloomFilter(kB, 5, 0)
+		require.NoError(t, err)
+		for j := 0; j < 20*i; j++ {
+			sha1 := randomSha1()
+			bf.insertSha1(sha1)
+			features = append(features, sha1)
+		}
+		indexes[i] = bf
+	}
+	for i := 0; i < 1000; i++ {
+		features = append(features, randomSha1())
+	}
+
+	for _, n := range []int{0, 1, 9, 64, 70} {
+		multi, err := NewMultiIndex(indexes[len(indexes)-n:])
+		require.NoError(t, err)
+		assert.Equal(t, n, multi.Len())
+		list := bloomFilterList(indexes[len(indexes)-n:])
+		expected, matches := make([]uint32, n), make([]uint32, n)
+		for _, sha1 := range features {
+			assert.Equal(t, list.searchSha1(sha1, expected), multi.searchSha1(sha1, matches))
+		}
+		assert.Equal(t, expected, matches)
+	}
+
+	small, err := newBloomFilter(2*kB, 5, 0)
+	require.NoError(t, err)
+	_, err = NewMultiIndex([]BloomFilter{indexes[0], small})
+	assert.Equal(t, ErrIncompatibleBloomFilter, err)
+	_, err = NewMultiIndex([]BloomFilter{indexes[0], nil})
+	assert.Equal(t, ErrIncompatibleBloomFilter, err)
+
+	// the digests searched with a MultiIndex are identical to the digests searched with a list of BloomFilter
+	buf := make([]uint8, 2*mB)
+	_, err = rand.New(rand.NewSource(2 * mB)).Read(buf)
+	require.NoError(t, err)
+	searchIndexes := []BloomFilter{NewBloomFilter(), NewBloomFilter(), NewBloomFilter()}
+	for i, index := range searchIndexes[:2] {
+		factory, err := CreateSdbfFromBytes(buf[i*mB/2 : i*mB/2+mB])
+		require.NoError(t, err)
+		_, err = factory.WithBlockSize(16 * kB).WithInitialIndex(index).Compute()
+		require.NoError(t, err)
+	}
+	multi, err := NewMultiIndex(searchIndexes)
+	require.NoError(t, err)
+	factory, err := CreateSdbfFromBytes(buf[mB/4:])
+	require.NoError(t, err)
+	expected, err := factory.WithBlockSize(16 * kB).WithSearchIndexes(searchIndexes).Compute()
+	require.NoError(t, err)
+	sd, err := factory.WithSearchMultiIndex(multi).Compute()
+	require.NoError(t, err)
+	var found [3]uint32
+	for _, matches := range expected.GetSearchIndexesResults() {
+		for i, match := range matches {
+			found[i] += match
+		}
+	}
+	assert.True(t, found[0] > 0 && found[1] > 0 && found[2] == 0)
+	assert.Equal(t, expected.GetSearchIndexesResults(), sd.GetSearchIndexesResults())
+	assert.Equal(t, expected.String(), sd.String())
+}
+
+func TestStreamIndexSearch(t *testing.T) {
+	buf := make([]uint8, 2*mB)
+	_, err := rand.New(rand.NewSource(3 * mB)).Read(buf)
+	require.NoError(t, err)
+	searchIndexes := []BloomFilter{NewBloomFilter(), NewBloomFilter()}
+	factory, err := CreateSdbfFromBytes(buf[:mB])
+	require.NoError(t, err)
+	_, err = factory.WithInitialIndex(searchIndexes[0]).Compute()
+	require.NoError(t, err)
+
+	factory, err = CreateSdbfFromBytes(buf[mB/2 : mB+mB/2])
+	require.NoError(t, err)
+	sd, err := factory.WithSearchIndexes(searchIndexes).Compute()
+	require.NoError(t, err)
+	results := sd.GetSearchIndexesResults()
+	require.Len(t, results, int(sd.FilterCount()))
+	for i, matches := range results {
+		require.Len(t, matches, 2)
+		assert.Zero(t, matches[1])
+		// the filters of the first half digest the features of the first index
+		if i < len(results)/2-1 {
+			assert.True(t, matches[0] > 0, "filter %d", i)
+		} else if i > len(results)/2+1 {
+			assert.Zero(t, matches[0], "filter %d", i)
+		}
+	}
+
+	plain, err := factory.WithSearchIndexes(nil).Compute()
+	require.NoError(t, err)
+	assert.Nil(t, plain.GetSearchIndexesResults())
+	assert.Equal(t, plain.String(), sd.String())
+
+	// features repeated in the input are searched before being skipped by the index, in both modes, so the second
+	// copy of the data matches the search index too; in stream mode it matches less, since the skipped features
+	// are still inserted in the last filter and hide the following ones
+	repeated := append(append([]uint8{}, buf[:mB/4]...), buf[:mB/4]...)
+	for _, blockSize := range []uint32{0, 16 * kB} {
+		matches := make([]uint32, 2)
+		for i, data := range [][]uint8{buf[:mB/4], repeated} {
+			factory, err := CreateSdbfFromBytes(data)
+			require.NoError(t, err)
+			sd, err := factory.WithBlockSize(blockSize).WithInitialIndex(NewBloomFilter()).
+				WithSearchIndexes(searchIndexes).Compute()
+			require.NoError(t, err)
+			for _, filterMatches := range sd.GetSearchIndexesResults() {
+				matches[i] += filterMatches[0]
+			}
+		}
+		require.NotZero(t, matches[0], "block size %d", blockSize)
+		if blockSize > 0 {
+			assert.Equal(t, 2*matches[0], matches[1], "block size %d", blockSize)
+		} else {
+			assert.True(t, matches[1] > matches[0]+matches[0]/10, "block size %d: %v", blockSize, matches)
+		}
+	}
+}
@@ -11,6 +11,12 @@ func memsetU8(buffer []uint8, v uint8) {
 	}
 }
 
+func memsetU16(buffer []uint16, v uint16) {
+	for i := range buffer {
+		buffer[i] = v
+	}
+}
+
 func u32sha1(data []uint8) [5]uint32 {
 	sha := sha1.Sum(data)
 